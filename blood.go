@@ -1,9 +1,19 @@
 package main
 
 import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "fmt"
+    "github.com/hyperledger/fabric-chaincode-go/shim"
     "github.com/hyperledger/fabric-contract-api-go/contractapi"
+    "reflect"
+    "regexp"
+    "sort"
+    "strings"
+    "time" // Import time for date formatting
 )
 
 // BloodDonationChaincode implements the smart contract for blood donation management
@@ -11,166 +21,5337 @@ type BloodDonationChaincode struct {
     contractapi.Contract
 }
 
+// stateCachingContext is the transaction context handed to every contract call. contractapi creates
+// a new one per invocation, so it can remember ledger reads for the rest of that transaction.
+type stateCachingContext struct {
+    contractapi.TransactionContext
+    stateCache map[string][]byte
+}
+
 // Donor structure to hold donor details
 type Donor struct {
+    DocType   string `json:"docType"` // Always "donor", distinguishes donors from other records
     DonorID   string `json:"donorID"`
     Name      string `json:"name"`
     BloodType string `json:"bloodType"`
+    DateOfBirth string `json:"dateOfBirth"` // Day of birth in dateFormat, used for the age limits on donation
+    Gender      string `json:"gender"` // "Male", "Female" or "Other"
+    Age         int    `json:"age,omitempty"` // Computed by QueryDonor from the transaction time, never stored
+    Email       string `json:"email"` // Contact for follow-up, recalls and eligibility reminders
+    PhoneNumber string `json:"phoneNumber"`
+    NotificationPreference string `json:"notificationPreference"` // "email", "sms" or "none", how eligibility reminders are sent
+    LastDonationDate string `json:"lastDonationDate"` // Date of the donor's most recent donation
+    Eligible       bool   `json:"eligible"` // False while the donor is medically deferred, true when missing from older records
+    DeferralReason string `json:"deferralReason"` // Why the donor is deferred, empty when eligible
+    ConsentStatus  bool   `json:"consentStatus"` // True once the donor has explicitly consented
+    ConsentDate    string `json:"consentDate"` // When consent was last given or revoked
+    PrivateDetails bool   `json:"privateDetails"` // True when the personal details live in donorPrivateCollection
+}
+
+// UnmarshalJSON reads a donor, treating one stored before the eligible field existed as eligible
+// rather than deferred
+func (d *Donor) UnmarshalJSON(data []byte) error {
+    type donorFields Donor // Same fields without this method, so decoding does not recurse
+    fields := donorFields{Eligible: true}
+    err := json.Unmarshal(data, &fields)
+    if err != nil {
+        return err
+    }
+    *d = Donor(fields)
+    return nil
+}
+
+// DonorPrivateDetails structure holding the personal details of a donor registered with RegisterDonorPrivate.
+// It lives in the donorPrivateCollection private data collection, only its hash reaches the channel ledger.
+type DonorPrivateDetails struct {
+    DocType     string `json:"docType"` // Always "donorPrivateDetails"
+    DonorID     string `json:"donorID"`
+    Name        string `json:"name"`
+    Email       string `json:"email"`
+    PhoneNumber string `json:"phoneNumber"`
+    DateOfBirth string `json:"dateOfBirth"` // Day of birth in dateFormat
+    Gender      string `json:"gender"`
+    Salt        string `json:"salt"` // Random per-donor secret chosen by the client, used for the donor hash on units
+}
+
+// EligibilityChange structure holding one deferral or reinstatement of a donor
+type EligibilityChange struct {
+    DocType    string `json:"docType"` // Always "eligibilityChange"
+    DonorID    string `json:"donorID"`
+    Eligible   bool   `json:"eligible"`
+    Reason     string `json:"reason"` // Deferral reason, empty for a reinstatement
+    Date       string `json:"date"`   // Date of the change
+    RecordedBy string `json:"recordedBy"` // Client identity that changed the eligibility
 }
 
 // Acceptor structure to hold acceptor (hospital) details, including phone number
 type Acceptor struct {
-    AcceptorID   string `json:"acceptorID"`
-    Name         string `json:"name"`
-    Location     string `json:"location"`
-    PhoneNumber  string `json:"phoneNumber"` // New field for phone number
+    DocType     string `json:"docType"` // Always "acceptor"
+    AcceptorID  string `json:"acceptorID"`
+    Name        string `json:"name"`
+    Location    string `json:"location"`
+    PhoneNumber string `json:"phoneNumber"` // New field for phone number
 }
 
 // BloodUnit structure to hold blood donation details
 type BloodUnit struct {
+    DocType     string `json:"docType"` // Always "bloodUnit"
     UnitID      string `json:"unitID"`
+    Version     int    `json:"version"` // Incremented on every write, see putBloodUnit
     DonorID     string `json:"donorID"`
+    DonorHash   string `json:"donorHash,omitempty"` // Salted hash replacing DonorID for donors registered with RegisterDonorPrivate
+    AcceptorID  string `json:"acceptorID"` // New field for Acceptor ID
     BloodType   string `json:"bloodType"`
-    Quantity    int    `json:"quantity"`
-    Status      string `json:"status"`     // e.g., "Collected", "Tested", "Available", "Partially Used", "Used", "Unsafe"
+    Quantity    int    `json:"quantity"` // Remaining volume in milliliters
+    OriginalQuantity int `json:"originalQuantity"` // Volume in milliliters at collection, never changed afterwards
+    DispensedQuantity int `json:"dispensedQuantity"` // Total volume in milliliters dispensed across all acceptances
+    Status      string `json:"status"`     // e.g., "Collected", "Quarantined", "Tested", "Available", "Reserved", "Partially Used", "Used", "Unsafe", "Separated", "Disposed", "Recalled", "Rejected", "Expired"
     TestResult  string `json:"testResult"` // e.g., "Safe", "Unsafe"
     HospitalName string `json:"hospitalName"` // New field for hospital name
+    Date        string `json:"date"` // New field for the date of donation
+    ExpiryDate  string `json:"expiryDate"` // Date after which the unit must not be dispensed
+    CollectedAt string `json:"collectedAt"` // Date as an RFC 3339 timestamp, used by range queries
+    ExpiresAt   string `json:"expiresAt"` // ExpiryDate as an RFC 3339 timestamp, used by range queries
+    ReservedBy  string `json:"reservedBy"` // Acceptor ID holding the reservation, if any
+    ReservedQuantity int `json:"reservedQuantity"` // Quantity held for the reserving acceptor
+    ComponentType string `json:"componentType"` // "Whole Blood", "RBC", "Plasma" or "Platelets"
+    ParentUnitID string `json:"parentUnitID"` // Whole blood unit a component was separated from
+    RecordedBy  string `json:"recordedBy"` // Client identity that recorded the donation
+    TestedBy    string `json:"testedBy"` // Client identity that recorded the test result
+    DisposalReason string `json:"disposalReason"` // Why the unit was disposed of
+    DisposalDate   string `json:"disposalDate"` // When the unit was disposed of
+    RecallReason   string `json:"recallReason"` // Why the unit was recalled
+    RejectionReason string `json:"rejectionReason"` // Why the donation was rejected at intake
+    RejectionDate   string `json:"rejectionDate"` // When the donation was rejected at intake
+    Remarks        []string `json:"remarks,omitempty"` // Timestamped free-text notes, oldest first, never edited
+    TemperatureExcursion bool `json:"temperatureExcursion"` // Set once a storage reading falls outside the safe range, never cleared
+    DirectedPatientID string `json:"directedPatientID"` // Patient a directed donation is reserved for, empty for ordinary donations
 }
 
-// Register a new donor
-func (s *BloodDonationChaincode) RegisterDonor(ctx contractapi.TransactionContextInterface, donorID string, name string, bloodType string) error {
-    donor := Donor{
-        DonorID:   donorID,
-        Name:      name,
-        BloodType: bloodType,
+// UsageHistory structure to hold the history of blood usage
+type UsageHistory struct {
+    DocType    string `json:"docType"` // Always "usageHistory"
+    UnitID     string `json:"unitID"`
+    AcceptorID string `json:"acceptorID"`
+    PatientID  string `json:"patientID"` // Patient the blood was transfused to
+    Quantity   int    `json:"quantity"`
+    Date       string `json:"date"` // Date of usage
+    UsedAt     string `json:"usedAt"` // Date as an RFC 3339 timestamp, used by range queries
+    RecordedBy string `json:"recordedBy"` // Client identity that dispensed the blood
+    EmergencyOverride bool `json:"emergencyOverride"` // True when dispensed below the reserve floor as an emergency
+}
+
+// DonationInput structure holding one donation of a RecordDonationBatch call
+type DonationInput struct {
+    UnitID       string `json:"unitID"`
+    DonorID      string `json:"donorID"`
+    BloodType    string `json:"bloodType"`
+    Quantity     int    `json:"quantity"` // Volume in milliliters
+    HospitalName string `json:"hospitalName"`
+    AcceptorID   string `json:"acceptorID"`
+}
+
+// UnitSearchCriteria structure holding the optional filters for QueryBloodUnits, empty fields match any unit
+type UnitSearchCriteria struct {
+    BloodType     string `json:"bloodType"`
+    Status        string `json:"status"`
+    HospitalName  string `json:"hospitalName"`
+    AcceptorID    string `json:"acceptorID"`
+    DonorID       string `json:"donorID"`
+    ComponentType string `json:"componentType"`
+}
+
+// TestResultInput structure holding one lab result of a TestBloodBatch call
+type TestResultInput struct {
+    UnitID     string `json:"unitID"`
+    TestResult string `json:"testResult"`
+}
+
+// BatchResult structure holding the outcome for one item of a batch call
+type BatchResult struct {
+    UnitID  string `json:"unitID"`
+    Success bool   `json:"success"`
+    Error   string `json:"error"` // Validation error when Success is false
+}
+
+// DonationCount structure holding how often and how much a donor has donated
+type DonationCount struct {
+    DonorID       string `json:"donorID"`
+    DonationCount int    `json:"donationCount"`
+    TotalQuantity int    `json:"totalQuantity"`
+}
+
+// DonationTrendBucket structure holding the donations collected in one period of GetDonationTrend
+type DonationTrendBucket struct {
+    Period        string `json:"period"` // Day or week start as YYYY-MM-DD, month as YYYY-MM
+    DonationCount int    `json:"donationCount"`
+    TotalQuantity int    `json:"totalQuantity"` // Milliliters collected
+}
+
+// NextEligibility structure holding when a donor may donate again, for off-chain reminder schedulers
+type NextEligibility struct {
+    DonorID                string `json:"donorID"`
+    NextEligibleDate       string `json:"nextEligibleDate"` // Empty while the donor is deferred
+    EligibleNow            bool   `json:"eligibleNow"`
+    Deferred               bool   `json:"deferred"` // Deferred donors are reinstated explicitly, not by time passing
+    NotificationPreference string `json:"notificationPreference"`
+}
+
+// DonorRanking structure holding one entry of the GetTopDonors leaderboard
+type DonorRanking struct {
+    DonorID          string `json:"donorID"`
+    Name             string `json:"name"` // Empty when the donor record has since been deleted
+    DonationCount    int    `json:"donationCount"`
+    LastDonationDate string `json:"lastDonationDate"` // Most recent collection, breaks ties in the ranking
+}
+
+// BloodTypeStatistics structure holding collection, usage and wastage figures for one blood type
+type BloodTypeStatistics struct {
+    BloodType      string `json:"bloodType"`
+    UnitsCollected int    `json:"unitsCollected"`
+    UnitsUsed      int    `json:"unitsUsed"`
+    UnitsWasted    int    `json:"unitsWasted"`
+}
+
+// DonationStatistics structure holding the ledger-wide donation report
+type DonationStatistics struct {
+    TotalDonors         int                    `json:"totalDonors"`
+    TotalUnitsCollected int                    `json:"totalUnitsCollected"`
+    TotalUnitsUsed      int                    `json:"totalUnitsUsed"`
+    TotalUnitsWasted    int                    `json:"totalUnitsWasted"`
+    WastageRate         float64                `json:"wastageRate"` // Wasted units divided by units collected
+    ByBloodType         []*BloodTypeStatistics `json:"byBloodType"`
+}
+
+// HospitalWastage structure holding one hospital's share of a wastage forecast
+type HospitalWastage struct {
+    HospitalName   string  `json:"hospitalName"`
+    UnitCount      int     `json:"unitCount"`
+    TotalQuantity  int     `json:"totalQuantity"` // Milliliters
+    EstimatedValue float64 `json:"estimatedValue"`
+}
+
+// WastageForecast structure holding the volume and value of available stock at risk of expiring unused
+type WastageForecast struct {
+    Days              int                `json:"days"`
+    CostPerMilliliter float64            `json:"costPerMilliliter"`
+    UnitCount         int                `json:"unitCount"`
+    TotalQuantity     int                `json:"totalQuantity"` // Milliliters
+    EstimatedValue    float64            `json:"estimatedValue"`
+    ByHospital        []*HospitalWastage `json:"byHospital"` // Highest value at risk first
+}
+
+// LedgerRecord structure holding one raw ledger record tagged with its docType, for export tooling
+type LedgerRecord struct {
+    Key     string          `json:"key"`
+    DocType string          `json:"docType"` // Empty when the value is not a JSON document
+    Record  json.RawMessage `json:"record"`
+}
+
+// RecordPage structure holding one page of ListAllRecordsPaginated
+type RecordPage struct {
+    Records             []*LedgerRecord `json:"records"`
+    FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+    Bookmark            string          `json:"bookmark"` // Pass to the next call to continue, empty once the last page is reached
+}
+
+// BloodUnitPage structure holding one page of a rich query over blood units. FetchedRecordsCount is the
+// count CouchDB reports for the page, comparing it with the number of units shows how much was filtered out.
+type BloodUnitPage struct {
+    Units               []*BloodUnit `json:"units"`
+    FetchedRecordsCount int32        `json:"fetchedRecordsCount"`
+    Bookmark            string       `json:"bookmark"` // Pass to the next call to continue, empty once the last page is reached
+}
+
+// DonorPage structure holding one page of a rich query over donors, see BloodUnitPage
+type DonorPage struct {
+    Donors              []*Donor `json:"donors"`
+    FetchedRecordsCount int32    `json:"fetchedRecordsCount"`
+    Bookmark            string   `json:"bookmark"`
+}
+
+// RecallResult structure holding the outcome of recalling a donor's units
+type RecallResult struct {
+    RecalledUnitIDs []string `json:"recalledUnitIDs"`
+    UsedUnitIDs     []string `json:"usedUnitIDs"` // Units already (partly) transfused, to be flagged for follow-up
+}
+
+// TimelineEvent structure holding one entry of a donor's chronological history
+type TimelineEvent struct {
+    EventType string `json:"eventType"` // "Donation", "Deferred" or "Reinstated"
+    Timestamp string `json:"timestamp"`
+    UnitID    string `json:"unitID"`    // Set for donations
+    Quantity  int    `json:"quantity"`  // Set for donations
+    Reason    string `json:"reason"`    // Set for deferrals
+}
+
+// TransferRecord structure to hold the history of blood moved between hospitals
+type TransferRecord struct {
+    DocType           string `json:"docType"` // Always "transferRecord"
+    UnitID            string `json:"unitID"`
+    TransferredUnitID string `json:"transferredUnitID"` // Unit now held by the receiver, differs from UnitID on partial transfers
+    FromAcceptorID    string `json:"fromAcceptorID"`
+    ToAcceptorID      string `json:"toAcceptorID"`
+    Quantity          int    `json:"quantity"`
+    Date              string `json:"date"` // Date of transfer
+    RecordedBy        string `json:"recordedBy"`
+}
+
+// UnitActivity structure holding one usage or transfer event of a blood unit
+type UnitActivity struct {
+    EventType string          `json:"eventType"` // "Usage" or "Transfer"
+    Date      string          `json:"date"`
+    Usage     *UsageHistory   `json:"usage,omitempty"`    // Set for usage events
+    Transfer  *TransferRecord `json:"transfer,omitempty"` // Set for transfer events
+}
+
+// CrossMatch structure holding the result of cross-matching a blood unit against a patient
+type CrossMatch struct {
+    DocType    string `json:"docType"` // Always "crossMatch"
+    UnitID     string `json:"unitID"`
+    PatientID  string `json:"patientID"`
+    Result     string `json:"result"` // "Compatible" or "Incompatible"
+    Date       string `json:"date"`   // Date of the cross-match
+    RecordedBy string `json:"recordedBy"` // Client identity that recorded the cross-match
+}
+
+// HashedBloodUnit structure holding a blood unit together with the hash of its stored bytes
+type HashedBloodUnit struct {
+    BloodUnit *BloodUnit `json:"bloodUnit"`
+    Hash      string     `json:"hash"` // Hex SHA-256 of the bytes exactly as stored on the ledger
+}
+
+// TemperatureReading structure holding one cold-chain storage reading of a blood unit
+type TemperatureReading struct {
+    DocType    string  `json:"docType"` // Always "temperatureReading"
+    UnitID     string  `json:"unitID"`
+    Celsius    float64 `json:"celsius"`
+    Excursion  bool    `json:"excursion"` // True when the reading is outside the unit's safe storage range
+    Date       string  `json:"date"`
+    RecordedBy string  `json:"recordedBy"` // Client identity that logged the reading
+}
+
+// UnitProvenance structure holding a blood unit together with the records it references
+type UnitProvenance struct {
+    BloodUnit      *BloodUnit        `json:"bloodUnit"`
+    Donor          *Donor            `json:"donor,omitempty"`    // Nil when the donor record is missing
+    Acceptor       *Acceptor         `json:"acceptor,omitempty"` // Current holder, nil when the record is missing
+    Transfers      []*TransferRecord `json:"transfers"`
+    Usage          []*UsageHistory   `json:"usage"`
+    MissingRecords []string          `json:"missingRecords"` // Referenced records that could not be found
+}
+
+// BloodUnitHistory structure to hold one version of a blood unit from the ledger history
+type BloodUnitHistory struct {
+    TxID      string     `json:"txID"`
+    Timestamp string     `json:"timestamp"`
+    IsDelete  bool       `json:"isDelete"`
+    BloodUnit *BloodUnit `json:"bloodUnit,omitempty"` // nil when the version is a deletion
+}
+
+// InventorySummary structure holding the available stock for one blood type
+type InventorySummary struct {
+    BloodType     string `json:"bloodType"`
+    TotalQuantity int    `json:"totalQuantity"`
+    UnitCount     int    `json:"unitCount"`
+}
+
+// InventoryCache structure holding the last computed inventory summary of one blood type, adjusted by
+// every write that changes its available stock so dashboards can read it without scanning all units.
+// Each blood type has its own key, so writes to different blood types never conflict on the cache.
+type InventoryCache struct {
+    DocType   string           `json:"docType"` // Always "inventoryCache"
+    Version   int              `json:"version"` // inventoryCacheVersion the summary was computed under
+    Summary   InventorySummary `json:"summary"`
+    UpdatedAt string           `json:"updatedAt"` // Timestamp of the transaction that last changed the cache
+}
+
+// inventoryCacheVersion is bumped whenever the rules for what counts as available stock change. A cache
+// written under older rules is treated as missing, so it gets recomputed instead of adjusted. Version 2
+// stopped counting "Tested" units, which older caches still include.
+const inventoryCacheVersion = 2
+
+// StatusCount structure holding the number of blood units in one status
+type StatusCount struct {
+    Status string `json:"status"`
+    Count  int    `json:"count"`
+}
+
+// EmergencyUnit structure holding a unit that can be dispatched in an emergency
+type EmergencyUnit struct {
+    UnitID       string `json:"unitID"`
+    BloodType    string `json:"bloodType"`
+    HospitalName string `json:"hospitalName"`
+    Quantity     int    `json:"quantity"`
+}
+
+// EmergencyMatch structure holding the units selected for an emergency request and any shortfall
+type EmergencyMatch struct {
+    Units         []*EmergencyUnit `json:"units"`
+    TotalQuantity int              `json:"totalQuantity"`
+    Shortfall     int              `json:"shortfall"` // Quantity still missing, zero when the request is covered
+}
+
+// AcceptResult structure holding the outcome of an AcceptBlood call
+type AcceptResult struct {
+    UnitID            string `json:"unitID"`
+    QuantityDispensed int    `json:"quantityDispensed"`
+    RemainingQuantity int    `json:"remainingQuantity"`
+    NewStatus         string `json:"newStatus"`
+}
+
+// LowStockThreshold structure holding the minimum safe stock level for a blood type
+type LowStockThreshold struct {
+    DocType   string `json:"docType"` // Always "lowStockThreshold"
+    BloodType string `json:"bloodType"`
+    Threshold int    `json:"threshold"`
+}
+
+// ReserveFloor structure holding the stock level of a blood type kept back for emergencies
+type ReserveFloor struct {
+    DocType   string `json:"docType"` // Always "reserveFloor"
+    BloodType string `json:"bloodType"`
+    Floor     int    `json:"floor"`
+}
+
+// EmergencyOverrideEvent structure holding the event log entry recorded when blood is dispensed below
+// the reserve floor of its blood type with the emergency override
+type EmergencyOverrideEvent struct {
+    BloodType    string   `json:"bloodType"`
+    UnitIDs      []string `json:"unitIDs"` // Units drawn on for the request
+    AcceptorID   string   `json:"acceptorID"`
+    PatientID    string   `json:"patientID"`
+    Quantity     int      `json:"quantity"`
+    CurrentLevel int      `json:"currentLevel"` // Stock left after dispensing
+    Floor        int      `json:"floor"`
+}
+
+// LowStockEvent structure holding the payload of the "LowStock" chaincode event
+type LowStockEvent struct {
+    BloodType    string `json:"bloodType"`
+    CurrentLevel int    `json:"currentLevel"`
+    Threshold    int    `json:"threshold"`
+    UnitID       string `json:"unitID"`     // Unit whose dispensing caused the drop
+    AcceptorID   string `json:"acceptorID"`
+    Quantity     int    `json:"quantity"`
+    Accepted     []BloodEvent `json:"accepted"` // Acceptances of the transaction, whose BloodAccepted event this replaces
+}
+
+// UnitStatusEvent structure holding the payload of events raised when a unit leaves circulation
+type UnitStatusEvent struct {
+    UnitID    string `json:"unitID"`
+    BloodType string `json:"bloodType"`
+    Status    string `json:"status"`
+    Reason    string `json:"reason"`
+}
+
+// EventLogEntry structure holding one entry of the on-chain audit log, kept alongside the Fabric
+// event of the same name because emitted events cannot be queried later
+type EventLogEntry struct {
+    DocType    string          `json:"docType"` // Always "eventLog"
+    EventType  string          `json:"eventType"` // e.g. "DonationRecorded", "BloodTested", "BloodAccepted"
+    TxID       string          `json:"txID"`
+    Date       string          `json:"date"`
+    RecordedBy string          `json:"recordedBy"` // Client identity that submitted the transaction
+    Payload    json.RawMessage `json:"payload"`
+}
+
+// ProcessedRequest structure marking a request made with an idempotency key as done, so a retry with the
+// same key returns the stored result instead of applying the request again
+type ProcessedRequest struct {
+    DocType        string          `json:"docType"` // Always "processedRequest"
+    Function       string          `json:"function"`
+    IdempotencyKey string          `json:"idempotencyKey"`
+    ArgsHash       string          `json:"argsHash"` // Fingerprint of the arguments, a key reused with other arguments is refused
+    TxID           string          `json:"txID"` // Transaction that applied the request
+    Date           string          `json:"date"`
+    Result         json.RawMessage `json:"result,omitempty"`
+}
+
+// BloodEvent structure holding the payload of the chaincode events emitted for inventory changes
+type BloodEvent struct {
+    UnitID     string `json:"unitID"`
+    BloodType  string `json:"bloodType"`
+    Quantity   int    `json:"quantity"`
+    AcceptorID string `json:"acceptorID"`
+}
+
+// ContractInfo structure holding the version details of the deployed chaincode
+type ContractInfo struct {
+    Version   string   `json:"version"`
+    BuildID   string   `json:"buildID"`
+    Functions []string `json:"functions"` // Transaction functions this version supports, sorted by name
+}
+
+// Sentinel errors returned, wrapped with the missing ID, when a record is not on the ledger,
+// so callers can tell a missing record apart from a ledger failure with errors.Is
+var (
+    ErrDonorNotFound    = errors.New("Donor does not exist")
+    ErrAcceptorNotFound = errors.New("Acceptor does not exist")
+    ErrUnitNotFound     = errors.New("Blood unit does not exist")
+)
+
+// ContractVersion is the version of the chaincode logic, bumped whenever its behavior changes
+const ContractVersion = "1.1.0"
+
+// buildID identifies the build that produced the deployed binary, set at build time with
+// -ldflags "-X main.buildID=<id>"
+var buildID = "dev"
+
+// dateTimeFormat is the layout of the human-readable dates stored on the ledger
+const dateTimeFormat = "2006-01-02 15:04:05"
+
+// formatTimestamp formats a time as an RFC 3339 timestamp in UTC to the second, for the fields rich
+// range queries run on. The explicit zone leaves no doubt about the instant, and the fixed width keeps
+// string comparison in time order.
+func formatTimestamp(t time.Time) string {
+    return t.UTC().Format(time.RFC3339)
+}
+
+// dateFormat is the layout accepted for day-only date parameters
+const dateFormat = "2006-01-02"
+
+// minDonationIntervalDays is the minimum number of days a donor must wait between whole blood donations
+const minDonationIntervalDays = 56
+
+// MinReasonableDonationVolume and MaxReasonableDonationVolume bound the volume, in milliliters,
+// accepted for a single whole blood donation
+const (
+    MinReasonableDonationVolume = 100
+    MaxReasonableDonationVolume = 500
+)
+
+// MinDonorAge and MaxDonorAge bound the age, in whole years, at which a donor may donate
+const (
+    MinDonorAge = 18
+    MaxDonorAge = 65
+)
+
+// costPerMilliliter is the estimated cost of collecting and processing one milliliter of blood,
+// used to value stock that may be wasted
+const costPerMilliliter = 0.5
+
+// donorPrivateCollection is the private data collection holding donor personal details, it must be
+// defined in the collection config the chaincode is approved with
+const donorPrivateCollection = "donorPrivateDetails"
+
+// minDonorSaltLength is the shortest salt accepted for a privately registered donor
+const minDonorSaltLength = 16
+
+// donorDetailsTransientKey is the transient map entry RegisterDonorPrivate reads the personal details from.
+// Transient data is not recorded in the transaction, so the details never appear on the channel ledger.
+const donorDetailsTransientKey = "donorDetails"
+
+// authorizedLabMSPID is the MSP of the laboratory organization allowed to record test results
+const authorizedLabMSPID = "LabMSP"
+
+// componentSplits gives the percentage of a whole blood unit that goes into each component,
+// in the order the component units are created
+var componentSplits = []struct {
+    ComponentType string
+    Percentage    int
+}{
+    {"RBC", 45},
+    {"Plasma", 45},
+    {"Platelets", 10},
+}
+
+// componentShelfLifeDays gives how many days each component type stays usable after collection
+var componentShelfLifeDays = map[string]int{
+    "Whole Blood": 42,
+    "RBC":         42,
+    "Plasma":      365,
+    "Platelets":   5,
+}
+
+// componentStorageRanges is the safe storage temperature range, in degrees Celsius, of each component type
+var componentStorageRanges = map[string]struct {
+    MinCelsius float64
+    MaxCelsius float64
+}{
+    "Whole Blood": {2, 6},
+    "RBC":         {2, 6},
+    "Plasma":      {-40, -18},
+    "Platelets":   {20, 24},
+}
+
+// validBloodTypes lists the canonical ABO/Rh blood groups accepted by the chaincode
+var validBloodTypes = map[string]bool{
+    "A+": true, "A-": true,
+    "B+": true, "B-": true,
+    "AB+": true, "AB-": true,
+    "O+": true, "O-": true,
+}
+
+// sortedBloodTypes returns the canonical blood groups in a fixed order, so every peer iterates them alike
+func sortedBloodTypes() []string {
+    bloodTypes := []string{}
+    for bloodType := range validBloodTypes {
+        bloodTypes = append(bloodTypes, bloodType)
     }
-    donorBytes, err := json.Marshal(donor)
+    sort.Strings(bloodTypes)
+    return bloodTypes
+}
+
+// isValidBloodType checks whether the given blood type is one of the canonical groups
+func isValidBloodType(bloodType string) bool {
+    return validBloodTypes[bloodType]
+}
+
+// normalizeBloodType upper-cases the blood type and rejects anything that is not a canonical group
+func normalizeBloodType(bloodType string) (string, error) {
+    normalized := strings.ToUpper(strings.TrimSpace(bloodType))
+    if !isValidBloodType(normalized) {
+        return "", fmt.Errorf("Invalid blood type %s, must be one of A+, A-, B+, B-, AB+, AB-, O+, O-", bloodType)
+    }
+    return normalized, nil
+}
+
+// bloodUnitStatuses lists every status a blood unit can be in, in lifecycle order
+var bloodUnitStatuses = []string{"Collected", "Quarantined", "Tested", "Available", "Reserved", "Partially Used", "Used", "Unsafe", "Separated", "Disposed", "Recalled", "Rejected", "Expired"}
+
+// isValidBloodUnitStatus checks whether a status is part of the blood unit lifecycle
+func isValidBloodUnitStatus(status string) bool {
+    for _, knownStatus := range bloodUnitStatuses {
+        if knownStatus == status {
+            return true
+        }
+    }
+    return false
+}
+
+// idPattern describes the accepted format of donor, acceptor and unit IDs. IDs are ledger keys, so
+// they must not be empty and must not contain whitespace or the null separator of composite keys.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// validateID checks that an ID given for a new record is usable as a ledger key, kind names the
+// record in the error message
+func validateID(kind string, id string) error {
+    if strings.TrimSpace(id) == "" {
+        return fmt.Errorf("%s ID is required", kind)
+    }
+    if !idPattern.MatchString(id) {
+        return fmt.Errorf("Invalid %s ID %q, use up to 64 letters, digits, '_', '.' or '-', starting with a letter or digit", strings.ToLower(kind), id)
+    }
+    return nil
+}
+
+// emailPattern and phonePattern describe the accepted formats of donor contact details
+var (
+    emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+    phonePattern = regexp.MustCompile(`^\+?[0-9][0-9 -]{5,18}[0-9]$`)
+)
+
+// validateContactDetails checks the format of an email address and phone number, either may be left empty
+func validateContactDetails(email string, phoneNumber string) error {
+    if email != "" && !emailPattern.MatchString(email) {
+        return fmt.Errorf("Invalid email address %s", email)
+    }
+    if phoneNumber != "" && !phonePattern.MatchString(phoneNumber) {
+        return fmt.Errorf("Invalid phone number %s", phoneNumber)
+    }
+    return nil
+}
+
+// testResults maps the lower-cased accepted lab results to their canonical spelling
+var testResults = map[string]string{"safe": "Safe", "unsafe": "Unsafe"}
+
+// normalizeTestResult converts a lab result to its canonical form, rejecting anything other than Safe or Unsafe
+// so that a typo can never silently mark blood unsafe
+func normalizeTestResult(testResult string) (string, error) {
+    normalized, ok := testResults[strings.ToLower(strings.TrimSpace(testResult))]
+    if !ok {
+        return "", fmt.Errorf("Invalid test result %s, must be Safe or Unsafe", testResult)
+    }
+    return normalized, nil
+}
+
+// validGenders lists the accepted values of a donor's gender
+var validGenders = map[string]bool{"Male": true, "Female": true, "Other": true}
+
+// validateNotificationPreference checks a donor's reminder channel and that the matching contact detail is present
+func validateNotificationPreference(notificationPreference string, email string, phoneNumber string) error {
+    switch notificationPreference {
+    case "none":
+    case "email":
+        if email == "" {
+            return fmt.Errorf("An email address is required for email notifications")
+        }
+    case "sms":
+        if phoneNumber == "" {
+            return fmt.Errorf("A phone number is required for sms notifications")
+        }
+    default:
+        return fmt.Errorf("Invalid notification preference %s, must be email, sms or none", notificationPreference)
+    }
+    return nil
+}
+
+// validateDonorDetails checks the date of birth and gender given for a donor
+func validateDonorDetails(dateOfBirth string, gender string) error {
+    if _, err := time.Parse(dateFormat, dateOfBirth); err != nil {
+        return fmt.Errorf("Invalid date of birth %s, expected YYYY-MM-DD", dateOfBirth)
+    }
+    if !validGenders[gender] {
+        return fmt.Errorf("Invalid gender %s, expected Male, Female or Other", gender)
+    }
+    return nil
+}
+
+// donorAge returns a donor's age on the given day, known is false when no date of birth is on record
+func donorAge(ctx contractapi.TransactionContextInterface, donor *Donor, now time.Time) (age int, known bool, err error) {
+    dateOfBirth := donor.DateOfBirth
+    if donor.PrivateDetails {
+        // Donors registered with RegisterDonorPrivate keep their date of birth in the private collection
+        details, err := getDonorPrivateDetails(ctx, donor.DonorID)
+        if err != nil {
+            return 0, false, err
+        }
+        if details != nil {
+            dateOfBirth = details.DateOfBirth
+        }
+    }
+    if dateOfBirth == "" {
+        return 0, false, nil
+    }
+    age, err = computeAge(dateOfBirth, now)
     if err != nil {
-        return err
+        return 0, false, err
     }
-    return ctx.GetStub().PutState(donorID, donorBytes)
+    return age, true, nil
 }
 
-// Register a new acceptor (hospital)
-func (s *BloodDonationChaincode) RegisterAcceptor(ctx contractapi.TransactionContextInterface, acceptorID string, name string, location string, phoneNumber string) error {
-    acceptor := Acceptor{
-        AcceptorID: acceptorID,
-        Name:       name,
-        Location:   location,
-        PhoneNumber: phoneNumber, // Add phone number to acceptor
+// isOfDonationAge reports whether a donor's age is known and within MinDonorAge and MaxDonorAge
+func isOfDonationAge(ctx contractapi.TransactionContextInterface, donor *Donor, now time.Time) (bool, error) {
+    age, known, err := donorAge(ctx, donor, now)
+    if err != nil {
+        return false, err
     }
-    acceptorBytes, err := json.Marshal(acceptor)
+    return known && age >= MinDonorAge && age <= MaxDonorAge, nil
+}
+
+// computeAge returns the age in whole years, on the given day, of someone born on dateOfBirth
+func computeAge(dateOfBirth string, now time.Time) (int, error) {
+    birth, err := time.Parse(dateFormat, dateOfBirth)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid date of birth %s, expected YYYY-MM-DD", dateOfBirth)
+    }
+    age := now.Year() - birth.Year()
+    // Not a year older until the birthday has been reached this year
+    if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+        age--
+    }
+    return age, nil
+}
+
+// statusTransitions is the blood unit state machine, listing the statuses each status may move to.
+// Used and Disposed are terminal.
+var statusTransitions = map[string][]string{
+    "Collected":      {"Quarantined", "Tested", "Unsafe", "Separated", "Rejected", "Recalled", "Disposed"},
+    "Quarantined":    {"Tested", "Unsafe", "Separated", "Rejected", "Recalled", "Disposed"},
+    "Tested":         {"Available", "Expired", "Recalled", "Disposed"},
+    "Available":      {"Reserved", "Partially Used", "Used", "Expired", "Recalled", "Disposed"},
+    "Reserved":       {"Reserved", "Available", "Partially Used", "Used", "Expired", "Recalled", "Disposed"},
+    "Partially Used": {"Partially Used", "Reserved", "Used", "Expired", "Recalled", "Disposed"},
+    "Unsafe":         {"Recalled", "Disposed"},
+    "Separated":      {"Recalled", "Disposed"},
+    "Rejected":       {"Disposed"},
+    "Recalled":       {"Disposed"},
+    "Expired":        {"Recalled", "Disposed"},
+}
+
+// canTransition checks whether the state machine allows a unit to move from one status to another
+func canTransition(from string, to string) bool {
+    for _, allowed := range statusTransitions[from] {
+        if allowed == to {
+            return true
+        }
+    }
+    return false
+}
+
+// setUnitStatus moves a blood unit to a new status, refusing transitions the state machine does not allow
+func setUnitStatus(bloodUnit *BloodUnit, status string) error {
+    if !canTransition(bloodUnit.Status, status) {
+        return fmt.Errorf("Blood unit %s cannot move from status %s to %s", bloodUnit.UnitID, bloodUnit.Status, status)
+    }
+    bloodUnit.Status = status
+    return nil
+}
+
+// availableStatuses are the unit statuses from which blood can still be dispensed. A unit's lifecycle is
+// Collected/Quarantined -> Tested (TestBlood) -> Available (MakeAvailable) -> Reserved (optional) ->
+// Partially Used -> Used, so a tested unit only counts as stock once it has been made available.
+var availableStatuses = []string{"Available", "Partially Used"}
+
+// isAvailableStatus checks whether a unit in the given status can still be dispensed
+func isAvailableStatus(status string) bool {
+    for _, availableStatus := range availableStatuses {
+        if status == availableStatus {
+            return true
+        }
+    }
+    return false
+}
+
+// compatibleDonorTypes maps a recipient blood type to the donor types it can safely receive (ABO/Rh red cell rules)
+var compatibleDonorTypes = map[string][]string{
+    "O-":  {"O-"},
+    "O+":  {"O-", "O+"},
+    "A-":  {"O-", "A-"},
+    "A+":  {"O-", "O+", "A-", "A+"},
+    "B-":  {"O-", "B-"},
+    "B+":  {"O-", "O+", "B-", "B+"},
+    "AB-": {"O-", "A-", "B-", "AB-"},
+    "AB+": {"O-", "O+", "A-", "A+", "B-", "B+", "AB-", "AB+"},
+}
+
+// getCompatibleDonorTypes returns the donor blood types a recipient of the given type can receive
+func getCompatibleDonorTypes(recipientBloodType string) ([]string, error) {
+    recipientBloodType, err := normalizeBloodType(recipientBloodType)
+    if err != nil {
+        return nil, err
+    }
+    return compatibleDonorTypes[recipientBloodType], nil
+}
+
+// getTxTime returns the transaction timestamp, which is identical on every endorsing peer
+func getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return time.Time{}, err
+    }
+    return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// emitEvent marshals the payload and sets it as the chaincode event for the transaction
+func emitEvent(ctx contractapi.TransactionContextInterface, eventName string, payload interface{}) error {
+    payloadBytes, err := json.Marshal(payload)
     if err != nil {
         return err
     }
-    return ctx.GetStub().PutState(acceptorID, acceptorBytes)
+    return ctx.GetStub().SetEvent(eventName, payloadBytes)
 }
 
-// Record a blood donation
-func (s *BloodDonationChaincode) RecordDonation(ctx contractapi.TransactionContextInterface, unitID string, donorID string, bloodType string, quantity int, hospitalName string) error {
-    bloodUnit := BloodUnit{
-        UnitID:      unitID,
-        DonorID:     donorID,
-        BloodType:   bloodType,
-        Quantity:    quantity,
-        Status:      "Collected",
-        HospitalName: hospitalName, // Add hospital name to blood unit
+// appendEventLog writes an entry to the append-only on-chain event log. A transaction may log several
+// entries of one type, so the key includes a digest of the payload to keep them apart.
+func appendEventLog(ctx contractapi.TransactionContextInterface, eventType string, payload interface{}) error {
+    payloadBytes, err := json.Marshal(payload)
+    if err != nil {
+        return err
     }
-    bloodBytes, err := json.Marshal(bloodUnit)
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+
+    digest := sha256.Sum256(payloadBytes)
+    txID := ctx.GetStub().GetTxID()
+    logKey, err := ctx.GetStub().CreateCompositeKey("eventLog", []string{eventType, txID, hex.EncodeToString(digest[:])})
+    if err != nil {
+        return err
+    }
+
+    entry := EventLogEntry{
+        DocType:    "eventLog",
+        EventType:  eventType,
+        TxID:       txID,
+        Date:       now.Format(dateTimeFormat),
+        RecordedBy: recordedBy,
+        Payload:    payloadBytes,
+    }
+    entryBytes, err := json.Marshal(entry)
     if err != nil {
         return err
     }
-    return ctx.GetStub().PutState(unitID, bloodBytes)
+    return putState(ctx, logKey, entryBytes)
 }
 
-// Test blood and update the test result and status
-func (s *BloodDonationChaincode) TestBlood(ctx contractapi.TransactionContextInterface, unitID string, testResult string) error {
-    bloodBytes, err := ctx.GetStub().GetState(unitID)
+// getProcessedRequest returns the marker left by an earlier request to function with the same idempotency
+// key, or nil if there is none or no key was given. A key reused with different arguments is refused.
+func getProcessedRequest(ctx contractapi.TransactionContextInterface, function string, idempotencyKey string, args interface{}) (*ProcessedRequest, error) {
+    if idempotencyKey == "" {
+        return nil, nil
+    }
+    if !idPattern.MatchString(idempotencyKey) {
+        return nil, fmt.Errorf("Invalid idempotency key %q, use up to 64 letters, digits, '_', '.' or '-', starting with a letter or digit", idempotencyKey)
+    }
+
+    markerKey, err := ctx.GetStub().CreateCompositeKey("processedRequest", []string{function, idempotencyKey})
+    if err != nil {
+        return nil, err
+    }
+    markerBytes, err := getState(ctx, markerKey)
+    if err != nil {
+        return nil, err
+    }
+    if markerBytes == nil {
+        return nil, nil
+    }
+
+    var marker ProcessedRequest
+    err = json.Unmarshal(markerBytes, &marker)
+    if err != nil {
+        return nil, err
+    }
+    argsHash, err := computeFingerprint(args)
+    if err != nil {
+        return nil, err
+    }
+    if marker.ArgsHash != argsHash {
+        return nil, fmt.Errorf("Idempotency key %s was already used for a different %s request in transaction %s", idempotencyKey, function, marker.TxID)
+    }
+    return &marker, nil
+}
+
+// putProcessedRequest marks a request made with an idempotency key as done, storing its result for retries.
+// Two concurrent requests with the same key both read the missing marker, so Fabric's MVCC check lets
+// only one of them commit.
+func putProcessedRequest(ctx contractapi.TransactionContextInterface, function string, idempotencyKey string, args interface{}, result interface{}) error {
+    if idempotencyKey == "" {
+        return nil
+    }
+    argsHash, err := computeFingerprint(args)
+    if err != nil {
+        return err
+    }
+    resultBytes, err := json.Marshal(result)
+    if err != nil {
+        return err
+    }
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+
+    markerKey, err := ctx.GetStub().CreateCompositeKey("processedRequest", []string{function, idempotencyKey})
+    if err != nil {
+        return err
+    }
+    marker := ProcessedRequest{
+        DocType:        "processedRequest",
+        Function:       function,
+        IdempotencyKey: idempotencyKey,
+        ArgsHash:       argsHash,
+        TxID:           ctx.GetStub().GetTxID(),
+        Date:           now.Format(dateTimeFormat),
+        Result:         resultBytes,
+    }
+    markerBytes, err := json.Marshal(marker)
+    if err != nil {
+        return err
+    }
+    return putState(ctx, markerKey, markerBytes)
+}
+
+// parseDateBound parses a date parameter given either as a full date-time or as a bare day.
+// A bare day used as an end bound covers the whole day.
+func parseDateBound(value string, endOfDay bool) (time.Time, error) {
+    parsed, err := time.Parse(dateTimeFormat, value)
+    if err == nil {
+        return parsed, nil
+    }
+    parsed, err = time.Parse(dateFormat, value)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("Invalid date %s, expected format %s or %s", value, dateFormat, dateTimeFormat)
+    }
+    if endOfDay {
+        parsed = parsed.Add(24*time.Hour - time.Second)
+    }
+    return parsed, nil
+}
+
+// buildSelectorQuery encodes a CouchDB selector as a query string, letting json.Marshal
+// escape every value instead of splicing caller input into the query text
+func buildSelectorQuery(selector map[string]interface{}) (string, error) {
+    queryBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+    if err != nil {
+        return "", err
+    }
+    return string(queryBytes), nil
+}
+
+// getClientIdentity returns the MSP ID and client ID of the submitter, used to audit who changed a record
+func getClientIdentity(ctx contractapi.TransactionContextInterface) (string, error) {
+    mspID, err := ctx.GetClientIdentity().GetMSPID()
+    if err != nil {
+        return "", fmt.Errorf("Failed to resolve client MSP ID: %v", err)
+    }
+    clientID, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return "", fmt.Errorf("Failed to resolve client identity: %v", err)
+    }
+    if mspID == "" || clientID == "" {
+        return "", fmt.Errorf("Failed to resolve client identity")
+    }
+    return fmt.Sprintf("%s:%s", mspID, clientID), nil
+}
+
+// checkLabAccess rejects callers that do not belong to the authorized lab organization
+func checkLabAccess(ctx contractapi.TransactionContextInterface) error {
+    mspID, err := ctx.GetClientIdentity().GetMSPID()
+    if err != nil {
+        return fmt.Errorf("Failed to resolve client MSP ID: %v", err)
+    }
+    if mspID != authorizedLabMSPID {
+        return fmt.Errorf("Permission denied: clients of %s are not allowed to record test results", mspID)
+    }
+    return nil
+}
+
+// GetShelfLife returns the number of days a component type stays usable after collection
+func GetShelfLife(componentType string) (int, error) {
+    days, ok := componentShelfLifeDays[componentType]
+    if !ok {
+        return 0, fmt.Errorf("Unknown component type %s", componentType)
+    }
+    return days, nil
+}
+
+// getState reads a ledger key, serving repeated reads within one transaction from the context's
+// cache. Writes drop the cached value instead of replacing it, because Fabric reads never see
+// writes made earlier in the same transaction and the cache must not either.
+func getState(ctx contractapi.TransactionContextInterface, key string) ([]byte, error) {
+    cachingCtx, ok := ctx.(*stateCachingContext)
+    if !ok {
+        return ctx.GetStub().GetState(key)
+    }
+    if value, cached := cachingCtx.stateCache[key]; cached {
+        return value, nil
+    }
+
+    value, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, err
+    }
+    if cachingCtx.stateCache == nil {
+        cachingCtx.stateCache = make(map[string][]byte)
+    }
+    cachingCtx.stateCache[key] = value
+    return value, nil
+}
+
+// putState writes a ledger key and invalidates any cached read of it
+func putState(ctx contractapi.TransactionContextInterface, key string, value []byte) error {
+    if cachingCtx, ok := ctx.(*stateCachingContext); ok {
+        delete(cachingCtx.stateCache, key)
+    }
+    return ctx.GetStub().PutState(key, value)
+}
+
+// delState deletes a ledger key and invalidates any cached read of it
+func delState(ctx contractapi.TransactionContextInterface, key string) error {
+    if cachingCtx, ok := ctx.(*stateCachingContext); ok {
+        delete(cachingCtx.stateCache, key)
+    }
+    return ctx.GetStub().DelState(key)
+}
+
+// collectResults drains a query iterator, unmarshaling every value into a T, and closes the iterator
+func collectResults[T any](resultsIterator shim.StateQueryIteratorInterface) ([]*T, error) {
+    defer resultsIterator.Close()
+
+    var results []*T
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var result T
+        err = json.Unmarshal(queryResponse.Value, &result)
+        if err != nil {
+            return nil, err
+        }
+        results = append(results, &result)
+    }
+
+    return results, nil
+}
+
+// computeFingerprint returns the hex SHA-256 of a value serialized as canonical JSON, with object keys
+// sorted, so the same content always hashes the same regardless of struct field order
+func computeFingerprint(value interface{}) (string, error) {
+    valueBytes, err := json.Marshal(value)
+    if err != nil {
+        return "", err
+    }
+
+    // Round-trip through a generic value, whose maps json.Marshal writes with sorted keys.
+    // UseNumber keeps integers exact instead of converting them to float64.
+    decoder := json.NewDecoder(bytes.NewReader(valueBytes))
+    decoder.UseNumber()
+    var generic interface{}
+    err = decoder.Decode(&generic)
+    if err != nil {
+        return "", err
+    }
+    canonicalBytes, err := json.Marshal(generic)
+    if err != nil {
+        return "", err
+    }
+
+    hash := sha256.Sum256(canonicalBytes)
+    return hex.EncodeToString(hash[:]), nil
+}
+
+// hashRecordBytes returns the hex SHA-256 of a record's bytes exactly as stored on the ledger. Unlike
+// computeFingerprint it does not canonicalize, so it detects any change to the stored value.
+func hashRecordBytes(recordBytes []byte) string {
+    hash := sha256.Sum256(recordBytes)
+    return hex.EncodeToString(hash[:])
+}
+
+// computeDonorHash returns the hex SHA-256 of a donor's salt followed by their ID. Without the salt,
+// which only members of the private collection can read, the hash cannot be matched to a donor by
+// hashing candidate IDs.
+func computeDonorHash(salt string, donorID string) string {
+    return hashRecordBytes([]byte(salt + donorID))
+}
+
+// putBloodUnit writes a blood unit, incrementing its version first. Fabric already rejects a transaction
+// whose reads went stale before it committed (MVCC_READ_CONFLICT), so two overlapping AcceptBlood calls
+// on one unit can never both commit. The version lets clients see that a unit changed since they read
+// it: on a conflict they should re-query the unit and decide again rather than blindly resubmit.
+// Units recorded before the RFC 3339 timestamps existed get them filled in on their next write.
+func putBloodUnit(ctx contractapi.TransactionContextInterface, bloodUnit *BloodUnit) error {
+    err := fillUnitTimestamps(bloodUnit)
+    if err != nil {
+        return err
+    }
+    bloodUnit.Version++
+    bloodBytes, err := json.Marshal(bloodUnit)
+    if err != nil {
+        return err
+    }
+    return putState(ctx, bloodUnit.UnitID, bloodBytes)
+}
+
+// fillUnitTimestamps derives any missing CollectedAt and ExpiresAt from the stored dates, which were
+// always written in UTC
+func fillUnitTimestamps(bloodUnit *BloodUnit) error {
+    if bloodUnit.CollectedAt == "" && bloodUnit.Date != "" {
+        collected, err := time.Parse(dateTimeFormat, bloodUnit.Date)
+        if err != nil {
+            return fmt.Errorf("Blood unit %s has an invalid collection date %s", bloodUnit.UnitID, bloodUnit.Date)
+        }
+        bloodUnit.CollectedAt = formatTimestamp(collected)
+    }
+    if bloodUnit.ExpiresAt == "" && bloodUnit.ExpiryDate != "" {
+        expiry, err := time.Parse(dateTimeFormat, bloodUnit.ExpiryDate)
+        if err != nil {
+            return fmt.Errorf("Blood unit %s has an invalid expiry date %s", bloodUnit.UnitID, bloodUnit.ExpiryDate)
+        }
+        bloodUnit.ExpiresAt = formatTimestamp(expiry)
+    }
+    return nil
+}
+
+// getDonor reads a donor from the ledger, failing if it does not exist or the ID holds another record
+func getDonor(ctx contractapi.TransactionContextInterface, donorID string) (*Donor, error) {
+    donorBytes, err := getState(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    if donorBytes == nil {
+        return nil, fmt.Errorf("%w: %s", ErrDonorNotFound, donorID)
+    }
+
+    var donor Donor
+    err = json.Unmarshal(donorBytes, &donor)
+    if err != nil {
+        return nil, err
+    }
+    // Donors, acceptors and units share one key space, any other record under the ID is not a donor
+    if donor.DocType != "donor" {
+        return nil, fmt.Errorf("%w: %s", ErrDonorNotFound, donorID)
+    }
+    return &donor, nil
+}
+
+// getDonorPrivateDetails reads a donor's personal details from the private data collection, returning
+// nil if there are none or this peer is not a member of the collection
+func getDonorPrivateDetails(ctx contractapi.TransactionContextInterface, donorID string) (*DonorPrivateDetails, error) {
+    detailsBytes, err := ctx.GetStub().GetPrivateData(donorPrivateCollection, donorID)
+    if err != nil {
+        return nil, fmt.Errorf("Failed to read private details of donor %s: %v", donorID, err)
+    }
+    if detailsBytes == nil {
+        return nil, nil
+    }
+
+    var details DonorPrivateDetails
+    err = json.Unmarshal(detailsBytes, &details)
+    if err != nil {
+        return nil, err
+    }
+    return &details, nil
+}
+
+// donorUnitsSelector returns the selector matching every blood unit given by a donor. Units of privately
+// registered donors carry a salted hash instead of the donor ID, so for those donors it also matches the
+// hash, read from the private collection. Public donors never touch the collection.
+func donorUnitsSelector(ctx contractapi.TransactionContextInterface, donorID string) (map[string]interface{}, error) {
+    selector := map[string]interface{}{"docType": "bloodUnit", "donorID": donorID}
+
+    donorBytes, err := getState(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    if donorBytes == nil {
+        return selector, nil
+    }
+    var donor Donor
+    err = json.Unmarshal(donorBytes, &donor)
+    if err != nil {
+        return nil, err
+    }
+    if !donor.PrivateDetails {
+        return selector, nil
+    }
+
+    details, err := getDonorPrivateDetails(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    if details == nil || details.Salt == "" {
+        return selector, nil
+    }
+    delete(selector, "donorID")
+    selector["$or"] = []interface{}{
+        map[string]interface{}{"donorID": donorID},
+        map[string]interface{}{"donorHash": computeDonorHash(details.Salt, donorID)},
+    }
+    return selector, nil
+}
+
+// getAcceptor reads an acceptor from the ledger, failing if it does not exist or the ID holds another record
+func getAcceptor(ctx contractapi.TransactionContextInterface, acceptorID string) (*Acceptor, error) {
+    acceptorBytes, err := getState(ctx, acceptorID)
+    if err != nil {
+        return nil, err
+    }
+    if acceptorBytes == nil {
+        return nil, fmt.Errorf("%w: %s", ErrAcceptorNotFound, acceptorID)
+    }
+
+    var acceptor Acceptor
+    err = json.Unmarshal(acceptorBytes, &acceptor)
+    if err != nil {
+        return nil, err
+    }
+    if acceptor.DocType != "acceptor" {
+        return nil, fmt.Errorf("%w: %s", ErrAcceptorNotFound, acceptorID)
+    }
+    return &acceptor, nil
+}
+
+// getBloodUnit reads a blood unit from the ledger, failing if it does not exist or the ID holds another record
+func getBloodUnit(ctx contractapi.TransactionContextInterface, unitID string) (*BloodUnit, error) {
+    bloodBytes, err := getState(ctx, unitID)
+    if err != nil {
+        return nil, err
+    }
+    if bloodBytes == nil {
+        return nil, fmt.Errorf("%w: %s", ErrUnitNotFound, unitID)
+    }
+
+    var bloodUnit BloodUnit
+    err = json.Unmarshal(bloodBytes, &bloodUnit)
+    if err != nil {
+        return nil, err
+    }
+    if bloodUnit.DocType != "bloodUnit" {
+        return nil, fmt.Errorf("%w: %s", ErrUnitNotFound, unitID)
+    }
+    return &bloodUnit, nil
+}
+
+// InitLedger seeds a new deployment with demo donors, hospitals and blood units across blood types
+// and statuses. A sentinel key marks the ledger as seeded so the data is only ever loaded once, and a
+// ledger that already holds donors or blood units, such as one upgraded from before the sentinel
+// existed, is refused so real records are never overwritten and the inventory cache stays complete.
+func (s *BloodDonationChaincode) InitLedger(ctx contractapi.TransactionContextInterface) error {
+    sentinelKey, err := ctx.GetStub().CreateCompositeKey("ledgerInitialized", []string{})
+    if err != nil {
+        return err
+    }
+    sentinelBytes, err := getState(ctx, sentinelKey)
+    if err != nil {
+        return err
+    }
+    if sentinelBytes != nil {
+        return fmt.Errorf("Ledger has already been initialized on %s", string(sentinelBytes))
+    }
+
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType": map[string]interface{}{"$in": []string{"donor", "bloodUnit"}},
+    })
+    if err != nil {
+        return err
+    }
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return err
+    }
+    existing := resultsIterator.HasNext()
+    resultsIterator.Close()
+    if existing {
+        return fmt.Errorf("Ledger already holds donors or blood units and cannot be seeded")
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+    shelfLifeDays, err := GetShelfLife("Whole Blood")
+    if err != nil {
+        return err
+    }
+    collected := now.AddDate(0, 0, -7)
+    date := collected.Format(dateTimeFormat)
+    expiryDate := collected.AddDate(0, 0, shelfLifeDays).Format(dateTimeFormat)
+
+    donors := []Donor{
+        {DonorID: "DONOR1", Name: "Asha Rao", BloodType: "O-", DateOfBirth: "1988-04-12", Gender: "Female", LastDonationDate: date},
+        {DonorID: "DONOR2", Name: "Ravi Kumar", BloodType: "A+", DateOfBirth: "1979-11-03", Gender: "Male", LastDonationDate: date},
+        {DonorID: "DONOR3", Name: "Meena Iyer", BloodType: "B+", DateOfBirth: "1995-07-21", Gender: "Female", LastDonationDate: date},
+        {DonorID: "DONOR4", Name: "John Mathew", BloodType: "AB-", DateOfBirth: "1983-02-28", Gender: "Male", LastDonationDate: date},
+        {DonorID: "DONOR5", Name: "Priya Shah", BloodType: "O+", DateOfBirth: "2000-09-15", Gender: "Female"},
+    }
+    acceptors := []Acceptor{
+        {AcceptorID: "ACCEPTOR1", Name: "City General Hospital", Location: "Hyderabad", PhoneNumber: "+91 40 2345 6789"},
+        {AcceptorID: "ACCEPTOR2", Name: "Lakeside Medical Centre", Location: "Bengaluru", PhoneNumber: "+91 80 2345 6789"},
+    }
+    bloodUnits := []BloodUnit{
+        {UnitID: "UNIT1", DonorID: "DONOR1", AcceptorID: "ACCEPTOR1", BloodType: "O-", Quantity: 450, Status: "Available", TestResult: "Safe"},
+        {UnitID: "UNIT2", DonorID: "DONOR2", AcceptorID: "ACCEPTOR1", BloodType: "A+", Quantity: 450, Status: "Quarantined"},
+        {UnitID: "UNIT3", DonorID: "DONOR3", AcceptorID: "ACCEPTOR2", BloodType: "B+", Quantity: 450, Status: "Unsafe", TestResult: "Unsafe"},
+        {UnitID: "UNIT4", DonorID: "DONOR4", AcceptorID: "ACCEPTOR2", BloodType: "AB-", Quantity: 450, Status: "Tested", TestResult: "Safe"},
+    }
+
+    // Seed keys are plain IDs, so a hospital or any other record using one would be overwritten
+    var seedKeys []string
+    for _, donor := range donors {
+        seedKeys = append(seedKeys, donor.DonorID)
+    }
+    for _, acceptor := range acceptors {
+        seedKeys = append(seedKeys, acceptor.AcceptorID)
+    }
+    for _, bloodUnit := range bloodUnits {
+        seedKeys = append(seedKeys, bloodUnit.UnitID)
+    }
+    for _, seedKey := range seedKeys {
+        existingBytes, err := getState(ctx, seedKey)
+        if err != nil {
+            return err
+        }
+        if existingBytes != nil {
+            return fmt.Errorf("Ledger already holds a record with ID %s and cannot be seeded", seedKey)
+        }
+    }
+
+    for _, donor := range donors {
+        donor.DocType = "donor"
+        donor.NotificationPreference = "none"
+        donor.Eligible = true
+        donor.ConsentStatus = true
+        donor.ConsentDate = date
+        donorBytes, err := json.Marshal(donor)
+        if err != nil {
+            return err
+        }
+        err = putState(ctx, donor.DonorID, donorBytes)
+        if err != nil {
+            return err
+        }
+    }
+
+    hospitalNames := make(map[string]string)
+    for _, acceptor := range acceptors {
+        acceptor.DocType = "acceptor"
+        hospitalNames[acceptor.AcceptorID] = acceptor.Name
+        acceptorBytes, err := json.Marshal(acceptor)
+        if err != nil {
+            return err
+        }
+        err = putState(ctx, acceptor.AcceptorID, acceptorBytes)
+        if err != nil {
+            return err
+        }
+    }
+
+    deltas := make(map[string]*InventorySummary)
+    for _, bloodUnit := range bloodUnits {
+        bloodUnit.DocType = "bloodUnit"
+        bloodUnit.OriginalQuantity = bloodUnit.Quantity
+        bloodUnit.HospitalName = hospitalNames[bloodUnit.AcceptorID]
+        bloodUnit.Date = date
+        bloodUnit.ExpiryDate = expiryDate
+        bloodUnit.CollectedAt = formatTimestamp(collected)
+        bloodUnit.ExpiresAt = formatTimestamp(collected.AddDate(0, 0, shelfLifeDays))
+        bloodUnit.ComponentType = "Whole Blood"
+        bloodUnit.RecordedBy = recordedBy
+        err = putBloodUnit(ctx, &bloodUnit)
+        if err != nil {
+            return err
+        }
+        trackInventoryChange(deltas, nil, &bloodUnit)
+    }
+
+    // The ledger starts empty, so the tracked changes are the whole inventory summary
+    inventory := []*InventorySummary{}
+    for _, summary := range deltas {
+        inventory = append(inventory, summary)
+    }
+    err = putInventorySummaries(ctx, inventory)
+    if err != nil {
+        return err
+    }
+
+    return putState(ctx, sentinelKey, []byte(now.Format(dateTimeFormat)))
+}
+
+// Register a new donor
+func (s *BloodDonationChaincode) RegisterDonor(ctx contractapi.TransactionContextInterface, donorID string, name string, bloodType string, email string, phoneNumber string, dateOfBirth string, gender string, notificationPreference string) error {
+    donor, err := newDonor(ctx, donorID, name, bloodType, email, phoneNumber, dateOfBirth, gender, notificationPreference)
+    if err != nil {
+        return err
+    }
+    donorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return err
+    }
+    return putState(ctx, donorID, donorBytes)
+}
+
+// RegisterDonorPrivate registers a donor whose personal details are kept in a private data collection.
+// The name, contact details, date of birth and gender are passed in the transient map under
+// donorDetailsTransientKey as a DonorPrivateDetails JSON object, so they never appear in the transaction.
+// Only the donor ID, blood type and donation bookkeeping are written to the public ledger.
+// The object must include a salt of at least minDonorSaltLength characters, generated randomly by the
+// client. Chaincode cannot generate it, as every endorser must produce the same result. The salt is
+// stored only in the collection and is never logged or returned outside QueryDonorPrivate.
+func (s *BloodDonationChaincode) RegisterDonorPrivate(ctx contractapi.TransactionContextInterface, donorID string, bloodType string, notificationPreference string) error {
+    details, err := getTransientDonorDetails(ctx)
+    if err != nil {
+        return err
+    }
+    if len(details.Salt) < minDonorSaltLength {
+        return fmt.Errorf("Donor details must include a random salt of at least %d characters", minDonorSaltLength)
+    }
+
+    donor, err := newDonor(ctx, donorID, details.Name, bloodType, details.Email, details.PhoneNumber, details.DateOfBirth, details.Gender, notificationPreference)
+    if err != nil {
+        return err
+    }
+
+    // Strip the personal details from the public record, they are only kept in the collection
+    donor.PrivateDetails = true
+    donor.Name = ""
+    donor.Email = ""
+    donor.PhoneNumber = ""
+    donor.DateOfBirth = ""
+    donor.Gender = ""
+    donorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return err
+    }
+    err = putState(ctx, donorID, donorBytes)
+    if err != nil {
+        return err
+    }
+
+    details.DocType = "donorPrivateDetails"
+    details.DonorID = donorID
+    detailsBytes, err := json.Marshal(details)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutPrivateData(donorPrivateCollection, donorID, detailsBytes)
+}
+
+// getTransientDonorDetails reads the DonorPrivateDetails passed in the transient map under donorDetailsTransientKey
+func getTransientDonorDetails(ctx contractapi.TransactionContextInterface) (*DonorPrivateDetails, error) {
+    transientMap, err := ctx.GetStub().GetTransient()
+    if err != nil {
+        return nil, fmt.Errorf("Failed to read the transient map: %v", err)
+    }
+    detailsJSON, ok := transientMap[donorDetailsTransientKey]
+    if !ok {
+        return nil, fmt.Errorf("Donor details must be passed in the transient map under %s", donorDetailsTransientKey)
+    }
+    var details DonorPrivateDetails
+    err = json.Unmarshal(detailsJSON, &details)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid donor details: %v", err)
+    }
+    return &details, nil
+}
+
+// UpdateDonorPrivate updates the personal details of a donor registered with RegisterDonorPrivate. The
+// new name, contact details, date of birth and gender are passed in the transient map like at
+// registration and only written to the private data collection. The stored salt is always kept, so
+// units already referencing the donor by hash still match; any salt in the new details is ignored.
+func (s *BloodDonationChaincode) UpdateDonorPrivate(ctx contractapi.TransactionContextInterface, donorID string, notificationPreference string) error {
+    details, err := getTransientDonorDetails(ctx)
+    if err != nil {
+        return err
+    }
+    err = validateContactDetails(details.Email, details.PhoneNumber)
+    if err != nil {
+        return err
+    }
+    err = validateDonorDetails(details.DateOfBirth, details.Gender)
+    if err != nil {
+        return err
+    }
+    err = validateNotificationPreference(notificationPreference, details.Email, details.PhoneNumber)
+    if err != nil {
+        return err
+    }
+
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return err
+    }
+    if !donor.PrivateDetails {
+        return fmt.Errorf("Donor %s keeps their details on the public ledger, use UpdateDonor instead", donorID)
+    }
+    existing, err := getDonorPrivateDetails(ctx, donorID)
+    if err != nil {
+        return err
+    }
+    if existing == nil {
+        return fmt.Errorf("%w: no private details for %s", ErrDonorNotFound, donorID)
+    }
+
+    donor.NotificationPreference = notificationPreference
+    donorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return err
+    }
+    err = putState(ctx, donorID, donorBytes)
+    if err != nil {
+        return err
+    }
+
+    details.DocType = "donorPrivateDetails"
+    details.DonorID = donorID
+    details.Salt = existing.Salt
+    detailsBytes, err := json.Marshal(details)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutPrivateData(donorPrivateCollection, donorID, detailsBytes)
+}
+
+// QueryDonorPrivate returns the personal details of a donor from the private data collection. It only
+// succeeds on peers of organisations that are members of the collection.
+func (s *BloodDonationChaincode) QueryDonorPrivate(ctx contractapi.TransactionContextInterface, donorID string) (*DonorPrivateDetails, error) {
+    details, err := getDonorPrivateDetails(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    if details == nil {
+        return nil, fmt.Errorf("%w: no private details for %s", ErrDonorNotFound, donorID)
+    }
+    return details, nil
+}
+
+// SetDonorHash backfills the donor's salted hash on a unit recorded before donations of privately
+// registered donors were hashed at creation, replacing its plaintext donor ID. The donor must have been
+// registered with RegisterDonorPrivate, and the caller's peer must be a member of the private collection
+// to read the salt. Earlier versions of such a unit in the ledger history still carry the plaintext ID.
+func (s *BloodDonationChaincode) SetDonorHash(ctx contractapi.TransactionContextInterface, unitID string) error {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+    if bloodUnit.DonorHash != "" {
+        return fmt.Errorf("Blood unit %s already references its donor by hash", unitID)
+    }
+
+    details, err := getDonorPrivateDetails(ctx, bloodUnit.DonorID)
+    if err != nil {
+        return err
+    }
+    if details == nil || details.Salt == "" {
+        return fmt.Errorf("Donor %s of blood unit %s has no private details with a salt", bloodUnit.DonorID, unitID)
+    }
+
+    bloodUnit.DonorHash = computeDonorHash(details.Salt, bloodUnit.DonorID)
+    bloodUnit.DonorID = ""
+    return putBloodUnit(ctx, bloodUnit)
+}
+
+// VerifyDonorHash checks whether a blood unit was given by the given donor, by recomputing the salted
+// hash from the private collection. Only peers of member organisations can read the salt to verify.
+func (s *BloodDonationChaincode) VerifyDonorHash(ctx contractapi.TransactionContextInterface, unitID string, donorID string) (bool, error) {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return false, err
+    }
+    if bloodUnit.DonorHash == "" {
+        return false, fmt.Errorf("Blood unit %s does not reference its donor by hash", unitID)
+    }
+
+    details, err := getDonorPrivateDetails(ctx, donorID)
+    if err != nil {
+        return false, err
+    }
+    if details == nil {
+        return false, fmt.Errorf("%w: no private details for %s", ErrDonorNotFound, donorID)
+    }
+    return computeDonorHash(details.Salt, donorID) == bloodUnit.DonorHash, nil
+}
+
+// newDonor validates the details of a donor to be registered and builds the record, without writing it
+func newDonor(ctx contractapi.TransactionContextInterface, donorID string, name string, bloodType string, email string, phoneNumber string, dateOfBirth string, gender string, notificationPreference string) (*Donor, error) {
+    err := validateID("Donor", donorID)
+    if err != nil {
+        return nil, err
+    }
+    bloodType, err = normalizeBloodType(bloodType)
+    if err != nil {
+        return nil, err
+    }
+    err = validateContactDetails(email, phoneNumber)
+    if err != nil {
+        return nil, err
+    }
+    err = validateDonorDetails(dateOfBirth, gender)
+    if err != nil {
+        return nil, err
+    }
+    err = validateNotificationPreference(notificationPreference, email, phoneNumber)
+    if err != nil {
+        return nil, err
+    }
+
+    existingBytes, err := getState(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    if existingBytes != nil {
+        return nil, fmt.Errorf("Donor with ID %s already exists", donorID)
+    }
+
+    return &Donor{
+        DocType:   "donor",
+        DonorID:   donorID,
+        Name:      name,
+        BloodType: bloodType,
+        DateOfBirth: dateOfBirth,
+        Gender:      gender,
+        Email:       email,
+        PhoneNumber: phoneNumber,
+        NotificationPreference: notificationPreference,
+        Eligible:  true,
+        ConsentStatus: false, // Donations stay blocked until consent is recorded
+    }, nil
+}
+
+// Update the name, blood type, contact and personal details of an existing donor. When the blood type
+// is corrected and propagateToUnits is set, the donor's units still awaiting their lab result are
+// corrected too and their IDs returned. Tested or dispensed units always keep their recorded type.
+// Donors registered with RegisterDonorPrivate are refused, their details are updated with UpdateDonorPrivate.
+func (s *BloodDonationChaincode) UpdateDonor(ctx contractapi.TransactionContextInterface, donorID string, name string, bloodType string, email string, phoneNumber string, dateOfBirth string, gender string, notificationPreference string, propagateToUnits bool) ([]string, error) {
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return nil, err
+    }
+    err = validateContactDetails(email, phoneNumber)
+    if err != nil {
+        return nil, err
+    }
+    err = validateDonorDetails(dateOfBirth, gender)
+    if err != nil {
+        return nil, err
+    }
+    err = validateNotificationPreference(notificationPreference, email, phoneNumber)
+    if err != nil {
+        return nil, err
+    }
+
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    // Writing the details here would put them on the public ledger
+    if donor.PrivateDetails {
+        return nil, fmt.Errorf("Donor %s keeps their details in the private collection, use UpdateDonorPrivate instead", donorID)
+    }
+    previousBloodType := donor.BloodType
+
+    // Apply the new values, the donor ID is left untouched
+    donor.Name = name
+    donor.BloodType = bloodType
+    donor.Email = email
+    donor.PhoneNumber = phoneNumber
+    donor.DateOfBirth = dateOfBirth
+    donor.Gender = gender
+    donor.NotificationPreference = notificationPreference
+
+    updatedDonorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return nil, err
+    }
+    err = putState(ctx, donorID, updatedDonorBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    correctedUnitIDs := []string{}
+    if !propagateToUnits || bloodType == previousBloodType {
+        return correctedUnitIDs, nil
+    }
+
+    bloodUnits, err := s.QueryDonationHistory(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    for _, bloodUnit := range bloodUnits {
+        // Once a unit has a lab result it may have been matched or dispensed on its recorded type,
+        // so only units still awaiting testing are corrected
+        if bloodUnit.Status != "Collected" && bloodUnit.Status != "Quarantined" {
+            continue
+        }
+        if bloodUnit.BloodType == bloodType {
+            continue
+        }
+
+        bloodUnit.BloodType = bloodType
+        err = putBloodUnit(ctx, bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        correctedUnitIDs = append(correctedUnitIDs, bloodUnit.UnitID)
+    }
+
+    return correctedUnitIDs, nil
+}
+
+// SetDonorDateOfBirth records the date of birth and gender of a donor registered before they were
+// required, so the donor passes the age check on donation again. Donors that already have a date of
+// birth are updated with UpdateDonor, and those registered with RegisterDonorPrivate with UpdateDonorPrivate.
+func (s *BloodDonationChaincode) SetDonorDateOfBirth(ctx contractapi.TransactionContextInterface, donorID string, dateOfBirth string, gender string) error {
+    err := validateDonorDetails(dateOfBirth, gender)
+    if err != nil {
+        return err
+    }
+
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return err
+    }
+    if donor.PrivateDetails {
+        return fmt.Errorf("Donor %s keeps their details in the private collection, use UpdateDonorPrivate instead", donorID)
+    }
+    if donor.DateOfBirth != "" {
+        return fmt.Errorf("Donor %s already has a date of birth on record, use UpdateDonor to correct it", donorID)
+    }
+
+    donor.DateOfBirth = dateOfBirth
+    donor.Gender = gender
+    donorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return err
+    }
+    return putState(ctx, donorID, donorBytes)
+}
+
+// SetDonorEligibility defers a donor for medical reasons or reinstates them
+func (s *BloodDonationChaincode) SetDonorEligibility(ctx contractapi.TransactionContextInterface, donorID string, eligible bool, reason string) error {
+    if !eligible && strings.TrimSpace(reason) == "" {
+        return fmt.Errorf("A deferral reason is required when marking a donor ineligible")
+    }
+
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return err
+    }
+
+    donor.Eligible = eligible
+    donor.DeferralReason = reason
+    if eligible {
+        donor.DeferralReason = ""
+    }
+
+    updatedDonorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return err
+    }
+    err = putState(ctx, donorID, updatedDonorBytes)
+    if err != nil {
+        return err
+    }
+
+    // Keep every change as its own record so earlier deferrals and their reasons are never lost
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    changeBytes, err := json.Marshal(EligibilityChange{
+        DocType:    "eligibilityChange",
+        DonorID:    donorID,
+        Eligible:   eligible,
+        Reason:     donor.DeferralReason,
+        Date:       now.Format(dateTimeFormat),
+        RecordedBy: recordedBy,
+    })
+    if err != nil {
+        return err
+    }
+    changeKey, err := ctx.GetStub().CreateCompositeKey("eligibilityChange", []string{donorID, ctx.GetStub().GetTxID()})
+    if err != nil {
+        return err
+    }
+    return putState(ctx, changeKey, changeBytes)
+}
+
+// QueryEligibilityHistory returns every deferral and reinstatement of a donor, oldest first
+func (s *BloodDonationChaincode) QueryEligibilityHistory(ctx contractapi.TransactionContextInterface, donorID string) ([]*EligibilityChange, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("eligibilityChange", []string{donorID})
+    if err != nil {
+        return nil, err
+    }
+    history, err := collectResults[EligibilityChange](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    sort.SliceStable(history, func(i, j int) bool {
+        return history[i].Date < history[j].Date
+    })
+
+    return history, nil
+}
+
+// RecordConsent stores whether a donor has given consent and when it was recorded
+func (s *BloodDonationChaincode) RecordConsent(ctx contractapi.TransactionContextInterface, donorID string, consentGiven bool, timestamp string) error {
+    consentTime, err := parseDateBound(timestamp, false)
+    if err != nil {
+        return err
+    }
+
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return err
+    }
+
+    donor.ConsentStatus = consentGiven
+    donor.ConsentDate = consentTime.Format(dateTimeFormat)
+
+    updatedDonorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return err
+    }
+    return putState(ctx, donorID, updatedDonorBytes)
+}
+
+// RevokeConsent withdraws a donor's consent, blocking any further donations
+func (s *BloodDonationChaincode) RevokeConsent(ctx contractapi.TransactionContextInterface, donorID string) error {
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    return s.RecordConsent(ctx, donorID, false, now.Format(dateTimeFormat))
+}
+
+// DeleteDonor removes a donor from the ledger. Deletion is refused while any blood unit
+// still references the donor, so donation records are never orphaned.
+func (s *BloodDonationChaincode) DeleteDonor(ctx contractapi.TransactionContextInterface, donorID string) error {
+    _, err := getDonor(ctx, donorID)
+    if err != nil {
+        return err
+    }
+
+    // Look for blood units that still reference this donor
+    selector, err := donorUnitsSelector(ctx, donorID)
+    if err != nil {
+        return err
+    }
+    queryString, err := buildSelectorQuery(selector)
+    if err != nil {
+        return err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return err
+    }
+    defer resultsIterator.Close()
+
+    var unitIDs []string
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return err
+        }
+        unitIDs = append(unitIDs, bloodUnit.UnitID)
+    }
+
+    if len(unitIDs) > 0 {
+        return fmt.Errorf("Donor with ID %s cannot be deleted, referenced by blood units: %s", donorID, strings.Join(unitIDs, ", "))
+    }
+
+    return delState(ctx, donorID)
+}
+
+// Register a new acceptor (hospital)
+func (s *BloodDonationChaincode) RegisterAcceptor(ctx contractapi.TransactionContextInterface, acceptorID string, name string, location string, phoneNumber string) error {
+    err := validateID("Acceptor", acceptorID)
+    if err != nil {
+        return err
+    }
+
+    existingBytes, err := getState(ctx, acceptorID)
+    if err != nil {
+        return err
+    }
+    if existingBytes != nil {
+        return fmt.Errorf("Acceptor with ID %s already exists", acceptorID)
+    }
+
+    acceptor := Acceptor{
+        DocType:     "acceptor",
+        AcceptorID:  acceptorID,
+        Name:        name,
+        Location:    location,
+        PhoneNumber: phoneNumber, // Add phone number to acceptor
+    }
+    acceptorBytes, err := json.Marshal(acceptor)
+    if err != nil {
+        return err
+    }
+    return putState(ctx, acceptorID, acceptorBytes)
+}
+
+// Update the name, location and phone number of an existing acceptor
+func (s *BloodDonationChaincode) UpdateAcceptor(ctx contractapi.TransactionContextInterface, acceptorID string, name string, location string, phoneNumber string) error {
+    acceptor, err := getAcceptor(ctx, acceptorID)
+    if err != nil {
+        return err
+    }
+
+    // Apply the new values, the acceptor ID is left untouched
+    acceptor.Name = name
+    acceptor.Location = location
+    acceptor.PhoneNumber = phoneNumber
+
+    updatedAcceptorBytes, err := json.Marshal(acceptor)
+    if err != nil {
+        return err
+    }
+    return putState(ctx, acceptorID, updatedAcceptorBytes)
+}
+
+// Record a blood donation. idempotencyKey is optional: a retry with the same key and arguments succeeds
+// without recording the donation again, pass an empty string to go without.
+func (s *BloodDonationChaincode) RecordDonation(ctx contractapi.TransactionContextInterface, unitID string, donorID string, bloodType string, quantity int, hospitalName string, acceptorID string, idempotencyKey string) error {
+    args := []interface{}{unitID, donorID, bloodType, quantity, hospitalName, acceptorID}
+    processed, err := getProcessedRequest(ctx, "RecordDonation", idempotencyKey, args)
+    if err != nil {
+        return err
+    }
+    if processed != nil {
+        return nil
+    }
+
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return err
+    }
+    err = recordDonation(ctx, unitID, donor, bloodType, quantity, hospitalName, acceptorID, "")
+    if err != nil {
+        return err
+    }
+    return putProcessedRequest(ctx, "RecordDonation", idempotencyKey, args, nil)
+}
+
+// RecordDirectedDonation records a donation made for a named patient. The unit can only ever be
+// dispensed to that patient.
+func (s *BloodDonationChaincode) RecordDirectedDonation(ctx contractapi.TransactionContextInterface, unitID string, donorID string, bloodType string, quantity int, hospitalName string, acceptorID string, patientID string) error {
+    if strings.TrimSpace(patientID) == "" {
+        return fmt.Errorf("A patient ID is required for a directed donation")
+    }
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return err
+    }
+    return recordDonation(ctx, unitID, donor, bloodType, quantity, hospitalName, acceptorID, patientID)
+}
+
+// RegisterAndDonate registers a walk-in donor and records their first donation in one transaction.
+// The donor is validated, and must consent, before anything is written, so a failed donation never
+// leaves the donor registered on their own.
+func (s *BloodDonationChaincode) RegisterAndDonate(ctx contractapi.TransactionContextInterface, donorID string, name string, bloodType string, email string, phoneNumber string, dateOfBirth string, gender string, notificationPreference string, consentGiven bool, unitID string, quantity int, hospitalName string, acceptorID string) error {
+    donor, err := newDonor(ctx, donorID, name, bloodType, email, phoneNumber, dateOfBirth, gender, notificationPreference)
+    if err != nil {
+        return err
+    }
+    if !consentGiven {
+        return fmt.Errorf("Donor %s must consent before donating", donorID)
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    donor.ConsentStatus = true
+    donor.ConsentDate = now.Format(dateTimeFormat)
+
+    // Reads do not see writes made earlier in the same transaction, so the donor is handed over in
+    // memory. recordDonation writes it once, together with its last donation date.
+    return recordDonation(ctx, unitID, donor, donor.BloodType, quantity, hospitalName, acceptorID, "")
+}
+
+// recordDonation validates and records a donation by the given donor, directedPatientID is empty for
+// ordinary donations. Every check runs before the first write.
+func recordDonation(ctx contractapi.TransactionContextInterface, unitID string, donor *Donor, bloodType string, quantity int, hospitalName string, acceptorID string, directedPatientID string) error {
+    donorID := donor.DonorID
+
+    // Quantities are milliliters, anything outside a plausible donation volume is a data entry error
+    if quantity < MinReasonableDonationVolume || quantity > MaxReasonableDonationVolume {
+        return fmt.Errorf("Donation volume must be between %d and %d mL, got %d", MinReasonableDonationVolume, MaxReasonableDonationVolume, quantity)
+    }
+    // Only the new unit's ID is validated, the donor and acceptor are looked up as registered
+    err := validateID("Unit", unitID)
+    if err != nil {
+        return err
+    }
+
+    bloodType, err = normalizeBloodType(bloodType)
+    if err != nil {
+        return err
+    }
+
+    // Never overwrite an existing unit, a resubmission would wipe its test results
+    existingBytes, err := getState(ctx, unitID)
+    if err != nil {
+        return err
+    }
+    if existingBytes != nil {
+        return fmt.Errorf("Blood unit with ID %s already exists", unitID)
+    }
+
+    // The acceptor holding the unit must already be registered
+    _, err = getAcceptor(ctx, acceptorID)
+    if err != nil {
+        return err
+    }
+
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+
+    // Get the current date and work out when the unit expires
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    shelfLifeDays, err := GetShelfLife("Whole Blood")
+    if err != nil {
+        return err
+    }
+    date := now.Format(dateTimeFormat)
+    expiry := now.AddDate(0, 0, shelfLifeDays)
+    expiryDate := expiry.Format(dateTimeFormat)
+
+    // Enforce the deferral interval since the donor's last donation and record this one
+    if !donor.ConsentStatus {
+        return fmt.Errorf("Donor %s has not given consent to donate", donorID)
+    }
+    if !donor.Eligible {
+        return fmt.Errorf("Donor %s is deferred from donating: %s", donorID, donor.DeferralReason)
+    }
+    age, known, err := donorAge(ctx, donor, now)
+    if err != nil {
+        return err
+    }
+    if !known {
+        return fmt.Errorf("Donor %s has no date of birth on record, the age limits cannot be checked; record it with SetDonorDateOfBirth", donorID)
+    }
+    if age < MinDonorAge || age > MaxDonorAge {
+        return fmt.Errorf("Donor %s is %d years old, donors must be between %d and %d", donorID, age, MinDonorAge, MaxDonorAge)
+    }
+
+    if donor.LastDonationDate != "" {
+        lastDonation, err := time.Parse(dateTimeFormat, donor.LastDonationDate)
+        if err != nil {
+            return err
+        }
+        eligibleDate := lastDonation.AddDate(0, 0, minDonationIntervalDays)
+        if now.Before(eligibleDate) {
+            return fmt.Errorf("Donor %s last donated on %s and is not eligible to donate again until %s", donorID, donor.LastDonationDate, eligibleDate.Format(dateTimeFormat))
+        }
+    }
+
+    // Units of privately registered donors reference them by salted hash only, so the donor ID never
+    // appears on the unit or in its history
+    unitDonorID, donorHash := donorID, ""
+    if donor.PrivateDetails {
+        details, err := getDonorPrivateDetails(ctx, donorID)
+        if err != nil {
+            return err
+        }
+        if details == nil || details.Salt == "" {
+            return fmt.Errorf("Donor %s has no private details with a salt", donorID)
+        }
+        unitDonorID, donorHash = "", computeDonorHash(details.Salt, donorID)
+    }
+
+    donor.LastDonationDate = date
+    updatedDonorBytes, err := json.Marshal(donor)
+    if err != nil {
+        return err
+    }
+    err = putState(ctx, donorID, updatedDonorBytes)
+    if err != nil {
+        return err
+    }
+
+    bloodUnit := BloodUnit{
+        DocType:     "bloodUnit",
+        UnitID:      unitID,
+        DonorID:     unitDonorID,
+        DonorHash:   donorHash,
+        AcceptorID:  acceptorID, // Add Acceptor ID
+        BloodType:   bloodType,
+        Quantity:    quantity,
+        OriginalQuantity: quantity,
+        Status:      "Quarantined", // Held back from stock until the lab result is in
+        HospitalName: hospitalName, // Add hospital name to blood unit
+        Date:        date, // Add current date
+        ExpiryDate:  expiryDate,
+        CollectedAt: formatTimestamp(now),
+        ExpiresAt:   formatTimestamp(expiry),
+        ComponentType: "Whole Blood",
+        RecordedBy:  recordedBy,
+        DirectedPatientID: directedPatientID,
+    }
+    err = putBloodUnit(ctx, &bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    donationEvent := BloodEvent{
+        UnitID:     unitID,
+        BloodType:  bloodType,
+        Quantity:   quantity,
+        AcceptorID: acceptorID,
+    }
+    err = appendEventLog(ctx, "DonationRecorded", donationEvent)
+    if err != nil {
+        return err
+    }
+
+    // Notify subscribed clients about the new unit
+    return emitEvent(ctx, "DonationRecorded", donationEvent)
+}
+
+// RecordDonationBatch records several donations in one transaction. Each entry is validated like
+// RecordDonation, and valid entries are written even when others in the batch fail.
+func (s *BloodDonationChaincode) RecordDonationBatch(ctx contractapi.TransactionContextInterface, donationsJSON string) ([]*BatchResult, error) {
+    var donations []DonationInput
+    err := json.Unmarshal([]byte(donationsJSON), &donations)
+    if err != nil {
+        return nil, fmt.Errorf("Failed to parse donations: %v", err)
+    }
+
+    // Reads do not see writes made earlier in the same transaction, so unit or donor IDs already
+    // recorded earlier in the batch have to be caught here. Failed entries wrote nothing and are not counted.
+    seenUnits := make(map[string]bool)
+    seenDonors := make(map[string]bool)
+
+    var results []*BatchResult
+    for _, donation := range donations {
+        result := &BatchResult{UnitID: donation.UnitID}
+        results = append(results, result)
+
+        if seenUnits[donation.UnitID] {
+            result.Error = fmt.Sprintf("Blood unit with ID %s appears more than once in the batch", donation.UnitID)
+            continue
+        }
+        if seenDonors[donation.DonorID] {
+            result.Error = fmt.Sprintf("Donor %s appears more than once in the batch", donation.DonorID)
+            continue
+        }
+
+        err = s.RecordDonation(ctx, donation.UnitID, donation.DonorID, donation.BloodType, donation.Quantity, donation.HospitalName, donation.AcceptorID, "")
+        if err != nil {
+            result.Error = err.Error()
+            continue
+        }
+        seenUnits[donation.UnitID] = true
+        seenDonors[donation.DonorID] = true
+        result.Success = true
+    }
+
+    // A transaction carries a single event, so replace the per-donation ones with a batch summary
+    err = emitEvent(ctx, "DonationBatchRecorded", results)
+    if err != nil {
+        return nil, err
+    }
+    return results, nil
+}
+
+// RejectDonation rejects a donation that failed intake pre-screening before it reached the lab.
+// Rejected units are distinct from "Unsafe" ones, which failed lab testing, and are never dispensed.
+func (s *BloodDonationChaincode) RejectDonation(ctx contractapi.TransactionContextInterface, unitID string, reason string) error {
+    if strings.TrimSpace(reason) == "" {
+        return fmt.Errorf("A rejection reason is required")
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    // Only donations still awaiting the lab can be rejected at intake
+    if bloodUnit.Status != "Quarantined" && bloodUnit.Status != "Collected" {
+        return fmt.Errorf("Blood unit %s cannot be rejected in status %s", unitID, bloodUnit.Status)
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+
+    err = setUnitStatus(bloodUnit, "Rejected")
+    if err != nil {
+        return err
+    }
+    bloodUnit.RejectionReason = reason
+    bloodUnit.RejectionDate = now.Format(dateTimeFormat)
+
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    return emitEvent(ctx, "DonationRejected", UnitStatusEvent{
+        UnitID:    unitID,
+        BloodType: bloodUnit.BloodType,
+        Status:    bloodUnit.Status,
+        Reason:    reason,
+    })
+}
+
+// Test blood and update the test result and status
+func (s *BloodDonationChaincode) TestBlood(ctx contractapi.TransactionContextInterface, unitID string, testResult string) error {
+    // Only the lab organization may mark blood as safe or unsafe
+    err := checkLabAccess(ctx)
+    if err != nil {
+        return err
+    }
+
+    deltas := make(map[string]*InventorySummary)
+    err = testBloodUnit(ctx, unitID, testResult, deltas)
+    if err != nil {
+        return err
+    }
+    return updateInventoryCache(ctx, deltas)
+}
+
+// TestBloodBatch records the lab results of several units at once, applying the same checks as
+// TestBlood to each. Valid results are recorded even when others in the batch fail.
+func (s *BloodDonationChaincode) TestBloodBatch(ctx contractapi.TransactionContextInterface, resultsJSON string) ([]*BatchResult, error) {
+    err := checkLabAccess(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    var testResults []TestResultInput
+    err = json.Unmarshal([]byte(resultsJSON), &testResults)
+    if err != nil {
+        return nil, fmt.Errorf("Failed to parse test results: %v", err)
+    }
+
+    // Reads do not see writes made earlier in the same transaction, so a unit listed twice
+    // would pass the already-tested check both times and has to be caught here
+    seenUnits := make(map[string]bool)
+    deltas := make(map[string]*InventorySummary)
+
+    var results []*BatchResult
+    for _, testResult := range testResults {
+        result := &BatchResult{UnitID: testResult.UnitID}
+        results = append(results, result)
+
+        if seenUnits[testResult.UnitID] {
+            result.Error = fmt.Sprintf("Blood unit with ID %s appears more than once in the batch", testResult.UnitID)
+            continue
+        }
+        seenUnits[testResult.UnitID] = true
+
+        err = testBloodUnit(ctx, testResult.UnitID, testResult.TestResult, deltas)
+        if err != nil {
+            result.Error = err.Error()
+            continue
+        }
+        result.Success = true
+    }
+
+    err = updateInventoryCache(ctx, deltas)
+    if err != nil {
+        return nil, err
+    }
+    return results, nil
+}
+
+// MakeAvailable releases a unit that tested safe into dispensable stock, moving it from "Tested" to "Available"
+func (s *BloodDonationChaincode) MakeAvailable(ctx contractapi.TransactionContextInterface, unitID string) error {
+    err := checkLabAccess(ctx)
+    if err != nil {
+        return err
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+    if bloodUnit.Status != "Tested" || bloodUnit.TestResult != "Safe" {
+        return fmt.Errorf("Only units tested safe can be made available, blood unit %s is %s", unitID, bloodUnit.Status)
+    }
+    if bloodUnit.TemperatureExcursion {
+        return fmt.Errorf("Blood unit %s has a recorded temperature excursion and cannot be made available", unitID)
+    }
+
+    before := *bloodUnit
+    err = setUnitStatus(bloodUnit, "Available")
+    if err != nil {
+        return err
+    }
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    deltas := make(map[string]*InventorySummary)
+    trackInventoryChange(deltas, &before, bloodUnit)
+    return updateInventoryCache(ctx, deltas)
+}
+
+// testBloodUnit records the lab result of one unit and tracks the resulting stock change in deltas
+func testBloodUnit(ctx contractapi.TransactionContextInterface, unitID string, testResult string, deltas map[string]*InventorySummary) error {
+    testResult, err := normalizeTestResult(testResult)
+    if err != nil {
+        return err
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    // Only units awaiting their lab result can be tested, a prior result must never be overwritten
+    if bloodUnit.Status == "Tested" || bloodUnit.Status == "Unsafe" {
+        return fmt.Errorf("Blood unit %s has already been tested with result %s", unitID, bloodUnit.TestResult)
+    }
+    if bloodUnit.Status != "Quarantined" && bloodUnit.Status != "Collected" {
+        return fmt.Errorf("Blood unit %s cannot be tested in status %s", unitID, bloodUnit.Status)
+    }
+
+    testedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+
+    // Update test result and status based on the test result
+    before := *bloodUnit
+    bloodUnit.TestResult = testResult
+    bloodUnit.TestedBy = testedBy
+    newStatus := "Unsafe"
+    if testResult == "Safe" {
+        newStatus = "Tested"
+    }
+    err = setUnitStatus(bloodUnit, newStatus)
+    if err != nil {
+        return err
+    }
+
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    trackInventoryChange(deltas, &before, bloodUnit)
+    return appendEventLog(ctx, "BloodTested", UnitStatusEvent{
+        UnitID:    unitID,
+        BloodType: bloodUnit.BloodType,
+        Status:    bloodUnit.Status,
+    })
+}
+
+// Query the details of a donor
+func (s *BloodDonationChaincode) QueryDonor(ctx contractapi.TransactionContextInterface, donorID string) (*Donor, error) {
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+
+    // Age changes with time, so it is worked out on every query rather than stored
+    if donor.DateOfBirth != "" {
+        now, err := getTxTime(ctx)
+        if err != nil {
+            return nil, err
+        }
+        donor.Age, err = computeAge(donor.DateOfBirth, now)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return donor, nil
+}
+
+// ComputeNextEligibleDate works out when a donor may next donate, from their last donation and the
+// minimum donation interval. Off-chain schedulers call it to send reminders on the donor's chosen channel.
+func (s *BloodDonationChaincode) ComputeNextEligibleDate(ctx contractapi.TransactionContextInterface, donorID string) (*NextEligibility, error) {
+    donor, err := getDonor(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    nextEligibility := NextEligibility{
+        DonorID:                donorID,
+        NotificationPreference: donor.NotificationPreference,
+    }
+    if !donor.Eligible {
+        nextEligibility.Deferred = true
+        return &nextEligibility, nil
+    }
+
+    // A donor who has never donated may donate straight away
+    nextEligibleDate := now
+    if donor.LastDonationDate != "" {
+        lastDonation, err := time.Parse(dateTimeFormat, donor.LastDonationDate)
+        if err != nil {
+            return nil, err
+        }
+        nextEligibleDate = lastDonation.AddDate(0, 0, minDonationIntervalDays)
+    }
+    nextEligibility.NextEligibleDate = nextEligibleDate.Format(dateTimeFormat)
+    nextEligibility.EligibleNow = !now.Before(nextEligibleDate)
+
+    return &nextEligibility, nil
+}
+
+// QueryAllDonors returns every registered donor by scanning the full key range
+func (s *BloodDonationChaincode) QueryAllDonors(ctx contractapi.TransactionContextInterface) ([]*Donor, error) {
+    // Empty start and end keys cover the whole key namespace
+    resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var donors []*Donor
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        // Donors share the key space with acceptors and blood units, so skip anything else
+        var donor Donor
+        err = json.Unmarshal(queryResponse.Value, &donor)
+        if err != nil {
+            return nil, err
+        }
+        if donor.DocType != "donor" {
+            continue
+        }
+        donors = append(donors, &donor)
+    }
+
+    return donors, nil
+}
+
+// ListAllRecordsPaginated pages through every record in the simple key range, so backups and exports
+// never need to hold the whole ledger in memory. Composite-key records such as usage history live in a
+// separate namespace and are not included.
+func (s *BloodDonationChaincode) ListAllRecordsPaginated(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*RecordPage, error) {
+    if pageSize <= 0 {
+        return nil, fmt.Errorf("Page size must be positive, got %d", pageSize)
+    }
+
+    // Empty start and end keys cover the whole key namespace
+    resultsIterator, metadata, err := ctx.GetStub().GetStateByRangeWithPagination("", "", pageSize, bookmark)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    page := RecordPage{Records: []*LedgerRecord{}}
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        record := &LedgerRecord{Key: queryResponse.Key, Record: queryResponse.Value}
+        var tagged struct {
+            DocType string `json:"docType"`
+        }
+        if json.Unmarshal(queryResponse.Value, &tagged) == nil {
+            record.DocType = tagged.DocType
+        } else {
+            // Keep values that are not JSON documents exportable by wrapping them in a JSON string
+            record.Record, err = json.Marshal(string(queryResponse.Value))
+            if err != nil {
+                return nil, err
+            }
+        }
+        page.Records = append(page.Records, record)
+    }
+    page.FetchedRecordsCount = metadata.FetchedRecordsCount
+    page.Bookmark = metadata.Bookmark
+
+    return &page, nil
+}
+
+// QueryDonorsByBloodType returns the donors of a blood type who could donate today: not medically
+// deferred, within the donor age limits and past the minimum interval since their last donation.
+// Donors without a date of birth on record are left out. Used for outreach when stock runs low.
+func (s *BloodDonationChaincode) QueryDonorsByBloodType(ctx contractapi.TransactionContextInterface, bloodType string) ([]*Donor, error) {
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    queryString, err := buildEligibleDonorQuery(bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    donors := []*Donor{}
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var donor Donor
+        err = json.Unmarshal(queryResponse.Value, &donor)
+        if err != nil {
+            return nil, err
+        }
+
+        // Skip donors still inside the deferral interval since their last donation
+        waiting, err := withinDonationInterval(&donor, now)
+        if err != nil {
+            return nil, err
+        }
+        if waiting {
+            continue
+        }
+        ofAge, err := isOfDonationAge(ctx, &donor, now)
+        if err != nil {
+            return nil, err
+        }
+        if !ofAge {
+            continue
+        }
+        donors = append(donors, &donor)
+    }
+
+    return donors, nil
+}
+
+// QueryDonorsByBloodTypeWithMetadata is QueryDonorsByBloodType one page at a time, returning the query
+// metadata as well. Donors inside the donation interval or outside the age limits are dropped after
+// the fetch, so a page can hold fewer donors than FetchedRecordsCount, or none at all while the
+// bookmark still points further on.
+func (s *BloodDonationChaincode) QueryDonorsByBloodTypeWithMetadata(ctx contractapi.TransactionContextInterface, bloodType string, pageSize int32, bookmark string) (*DonorPage, error) {
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return nil, err
+    }
+    if pageSize <= 0 {
+        return nil, fmt.Errorf("Page size must be positive, got %d", pageSize)
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    queryString, err := buildEligibleDonorQuery(bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
+    if err != nil {
+        return nil, err
+    }
+    fetched, err := collectResults[Donor](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    page := DonorPage{Donors: []*Donor{}, FetchedRecordsCount: metadata.FetchedRecordsCount, Bookmark: metadata.Bookmark}
+    for _, donor := range fetched {
+        waiting, err := withinDonationInterval(donor, now)
+        if err != nil {
+            return nil, err
+        }
+        if waiting {
+            continue
+        }
+        ofAge, err := isOfDonationAge(ctx, donor, now)
+        if err != nil {
+            return nil, err
+        }
+        if ofAge {
+            page.Donors = append(page.Donors, donor)
+        }
+    }
+
+    return &page, nil
+}
+
+// buildEligibleDonorQuery builds the rich query for the donors of a blood type who are not deferred,
+// including donors stored before the eligible field existed
+func buildEligibleDonorQuery(bloodType string) (string, error) {
+    return buildSelectorQuery(map[string]interface{}{
+        "docType":   "donor",
+        "bloodType": bloodType,
+        "$or": []interface{}{
+            map[string]interface{}{"eligible": true},
+            map[string]interface{}{"eligible": map[string]interface{}{"$exists": false}},
+        },
+    })
+}
+
+// withinDonationInterval reports whether a donor last donated less than the minimum interval before now
+func withinDonationInterval(donor *Donor, now time.Time) (bool, error) {
+    if donor.LastDonationDate == "" {
+        return false, nil
+    }
+    lastDonation, err := time.Parse(dateTimeFormat, donor.LastDonationDate)
+    if err != nil {
+        return false, err
+    }
+    return now.Before(lastDonation.AddDate(0, 0, minDonationIntervalDays)), nil
+}
+
+// CheckPossibleDuplicate returns the registered donors with the same name, ignoring case, and blood
+// type, so intake staff can confirm the person is not already on file. It is advisory only and
+// never blocks a registration.
+func (s *BloodDonationChaincode) CheckPossibleDuplicate(ctx contractapi.TransactionContextInterface, name string, bloodType string) ([]*Donor, error) {
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    // Anchor and quote the name so it is matched literally rather than as a pattern
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":   "donor",
+        "bloodType": bloodType,
+        "name":      map[string]interface{}{"$regex": "(?i)^" + regexp.QuoteMeta(strings.TrimSpace(name)) + "$"},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    donors := []*Donor{}
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var donor Donor
+        err = json.Unmarshal(queryResponse.Value, &donor)
+        if err != nil {
+            return nil, err
+        }
+        donors = append(donors, &donor)
+    }
+
+    return donors, nil
+}
+
+// Query the details of an acceptor
+func (s *BloodDonationChaincode) QueryAcceptor(ctx contractapi.TransactionContextInterface, acceptorID string) (*Acceptor, error) {
+    acceptor, err := getAcceptor(ctx, acceptorID)
+    if err != nil {
+        return nil, err
+    }
+    return acceptor, nil
+}
+
+// QueryAcceptorsByLocation returns the acceptors registered in a location, ignoring case
+// since locations are entered by hand
+func (s *BloodDonationChaincode) QueryAcceptorsByLocation(ctx contractapi.TransactionContextInterface, location string) ([]*Acceptor, error) {
+    // Anchor and quote the location so it is matched literally rather than as a pattern
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":  "acceptor",
+        "location": map[string]interface{}{"$regex": "(?i)^" + regexp.QuoteMeta(strings.TrimSpace(location)) + "$"},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var acceptors []*Acceptor
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var acceptor Acceptor
+        err = json.Unmarshal(queryResponse.Value, &acceptor)
+        if err != nil {
+            return nil, err
+        }
+        acceptors = append(acceptors, &acceptor)
+    }
+
+    return acceptors, nil
+}
+
+// GetUnitFingerprint returns the SHA-256 of a blood unit's canonical JSON, letting off-chain copies
+// check they still match the ledger
+func (s *BloodDonationChaincode) GetUnitFingerprint(ctx contractapi.TransactionContextInterface, unitID string) (string, error) {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return "", err
+    }
+    return computeFingerprint(bloodUnit)
+}
+
+// QueryBloodUnitWithHash returns a blood unit along with the hash of its stored bytes, so clients can
+// detect tampering or drift in their off-chain copies
+func (s *BloodDonationChaincode) QueryBloodUnitWithHash(ctx contractapi.TransactionContextInterface, unitID string) (*HashedBloodUnit, error) {
+    bloodBytes, err := getState(ctx, unitID)
+    if err != nil {
+        return nil, err
+    }
+    if bloodBytes == nil {
+        return nil, fmt.Errorf("%w: %s", ErrUnitNotFound, unitID)
+    }
+
+    var bloodUnit BloodUnit
+    err = json.Unmarshal(bloodBytes, &bloodUnit)
+    if err != nil {
+        return nil, err
+    }
+    if bloodUnit.DocType != "bloodUnit" {
+        return nil, fmt.Errorf("%w: %s", ErrUnitNotFound, unitID)
+    }
+    return &HashedBloodUnit{BloodUnit: &bloodUnit, Hash: hashRecordBytes(bloodBytes)}, nil
+}
+
+// VerifyRecordIntegrity reports whether the bytes stored under any ledger key still match a hash held
+// by the client, as returned by QueryBloodUnitWithHash
+func (s *BloodDonationChaincode) VerifyRecordIntegrity(ctx contractapi.TransactionContextInterface, key string, expectedHash string) (bool, error) {
+    recordBytes, err := getState(ctx, key)
+    if err != nil {
+        return false, err
+    }
+    if recordBytes == nil {
+        return false, fmt.Errorf("No record exists with key %s", key)
+    }
+    return strings.EqualFold(hashRecordBytes(recordBytes), strings.TrimSpace(expectedHash)), nil
+}
+
+// Query the details of a blood unit
+func (s *BloodDonationChaincode) QueryBloodUnit(ctx contractapi.TransactionContextInterface, unitID string) (*BloodUnit, error) {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return nil, err
+    }
+    return bloodUnit, nil
+}
+
+// QueryBloodUnitHistory returns every recorded version of a blood unit, oldest first
+func (s *BloodDonationChaincode) QueryBloodUnitHistory(ctx contractapi.TransactionContextInterface, unitID string) ([]*BloodUnitHistory, error) {
+    resultsIterator, err := ctx.GetStub().GetHistoryForKey(unitID)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var history []*BloodUnitHistory
+    for resultsIterator.HasNext() {
+        modification, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        entry := BloodUnitHistory{
+            TxID:     modification.TxId,
+            IsDelete: modification.IsDelete,
+        }
+        if modification.Timestamp != nil {
+            entry.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(dateTimeFormat)
+        }
+
+        // Deletions carry no value, so there is no unit to unmarshal
+        if !modification.IsDelete {
+            var bloodUnit BloodUnit
+            err = json.Unmarshal(modification.Value, &bloodUnit)
+            if err != nil {
+                return nil, err
+            }
+            entry.BloodUnit = &bloodUnit
+        }
+        history = append(history, &entry)
+    }
+
+    // Fabric returns history newest first, so reverse it before sorting to keep same-second versions in order
+    for left, right := 0, len(history)-1; left < right; left, right = left+1, right-1 {
+        history[left], history[right] = history[right], history[left]
+    }
+    sort.SliceStable(history, func(i, j int) bool {
+        return history[i].Timestamp < history[j].Timestamp
+    })
+
+    return history, nil
+}
+
+// Query blood units by blood type
+func (s *BloodDonationChaincode) QueryBloodUnitsByType(ctx contractapi.TransactionContextInterface, bloodType string) ([]*BloodUnit, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":   "bloodUnit",
+        "bloodType": bloodType,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    return collectResults[BloodUnit](resultsIterator)
+}
+
+// QueryBloodUnitsByHospital returns the blood units recorded against a hospital name
+func (s *BloodDonationChaincode) QueryBloodUnitsByHospital(ctx contractapi.TransactionContextInterface, hospitalName string) ([]*BloodUnit, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":      "bloodUnit",
+        "hospitalName": hospitalName,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    return collectResults[BloodUnit](resultsIterator)
+}
+
+// QueryBloodUnitsByAcceptor returns the blood units held by an acceptor. Hospital names are free
+// text, so this is the reliable lookup when the acceptor ID is known.
+func (s *BloodDonationChaincode) QueryBloodUnitsByAcceptor(ctx contractapi.TransactionContextInterface, acceptorID string) ([]*BloodUnit, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "acceptorID": acceptorID,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    return collectResults[BloodUnit](resultsIterator)
+}
+
+// QueryBloodUnitsByTypeSorted returns the blood units of a blood type ordered by "date", "expiry" or
+// "quantity", in "asc" or "desc" direction. The sort runs here rather than in CouchDB, which would
+// need an index for every sortable field.
+func (s *BloodDonationChaincode) QueryBloodUnitsByTypeSorted(ctx contractapi.TransactionContextInterface, bloodType string, sortBy string, direction string) ([]*BloodUnit, error) {
+    var less func(a, b *BloodUnit) bool
+    switch sortBy {
+    case "date":
+        less = func(a, b *BloodUnit) bool { return a.Date < b.Date }
+    case "expiry":
+        less = func(a, b *BloodUnit) bool { return a.ExpiryDate < b.ExpiryDate }
+    case "quantity":
+        less = func(a, b *BloodUnit) bool { return a.Quantity < b.Quantity }
+    default:
+        return nil, fmt.Errorf("Invalid sort field %s, must be one of date, expiry, quantity", sortBy)
+    }
+    if direction != "asc" && direction != "desc" {
+        return nil, fmt.Errorf("Invalid sort direction %s, must be asc or desc", direction)
+    }
+
+    bloodUnits, err := s.QueryBloodUnitsByType(ctx, bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    sort.SliceStable(bloodUnits, func(i, j int) bool {
+        if direction == "desc" {
+            return less(bloodUnits[j], bloodUnits[i])
+        }
+        return less(bloodUnits[i], bloodUnits[j])
+    })
+
+    return bloodUnits, nil
+}
+
+// QueryBloodUnits returns the blood units matching every filter given in criteriaJSON,
+// e.g. {"bloodType":"O-","status":"Available","hospitalName":"City Hospital"}
+func (s *BloodDonationChaincode) QueryBloodUnits(ctx contractapi.TransactionContextInterface, criteriaJSON string) ([]*BloodUnit, error) {
+    queryString, err := buildUnitSearchQuery(criteriaJSON)
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var bloodUnits []*BloodUnit
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        bloodUnits = append(bloodUnits, &bloodUnit)
+    }
+
+    return bloodUnits, nil
+}
+
+// QueryBloodUnitsWithMetadata is QueryBloodUnits one page at a time, returning the query metadata as well
+func (s *BloodDonationChaincode) QueryBloodUnitsWithMetadata(ctx contractapi.TransactionContextInterface, criteriaJSON string, pageSize int32, bookmark string) (*BloodUnitPage, error) {
+    queryString, err := buildUnitSearchQuery(criteriaJSON)
+    if err != nil {
+        return nil, err
+    }
+    return queryBloodUnitPage(ctx, queryString, pageSize, bookmark)
+}
+
+// buildUnitSearchQuery builds the rich query for a UnitSearchCriteria JSON object
+func buildUnitSearchQuery(criteriaJSON string) (string, error) {
+    var criteria UnitSearchCriteria
+    err := json.Unmarshal([]byte(criteriaJSON), &criteria)
+    if err != nil {
+        return "", fmt.Errorf("Failed to parse search criteria: %v", err)
+    }
+
+    // Only the filters that were provided constrain the query
+    selector := map[string]interface{}{"docType": "bloodUnit"}
+    if criteria.BloodType != "" {
+        bloodType, err := normalizeBloodType(criteria.BloodType)
+        if err != nil {
+            return "", err
+        }
+        selector["bloodType"] = bloodType
+    }
+    if criteria.Status != "" {
+        if !isValidBloodUnitStatus(criteria.Status) {
+            return "", fmt.Errorf("Invalid blood unit status %s", criteria.Status)
+        }
+        selector["status"] = criteria.Status
+    }
+    if criteria.HospitalName != "" {
+        selector["hospitalName"] = criteria.HospitalName
+    }
+    if criteria.AcceptorID != "" {
+        selector["acceptorID"] = criteria.AcceptorID
+    }
+    if criteria.DonorID != "" {
+        selector["donorID"] = criteria.DonorID
+    }
+    if criteria.ComponentType != "" {
+        selector["componentType"] = criteria.ComponentType
+    }
+
+    return buildSelectorQuery(selector)
+}
+
+// queryBloodUnitPage runs one page of a rich query over blood units, keeping the query metadata
+func queryBloodUnitPage(ctx contractapi.TransactionContextInterface, queryString string, pageSize int32, bookmark string) (*BloodUnitPage, error) {
+    if pageSize <= 0 {
+        return nil, fmt.Errorf("Page size must be positive, got %d", pageSize)
+    }
+
+    resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
+    if err != nil {
+        return nil, err
+    }
+
+    units, err := collectResults[BloodUnit](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+    return &BloodUnitPage{Units: units, FetchedRecordsCount: metadata.FetchedRecordsCount, Bookmark: metadata.Bookmark}, nil
+}
+
+// QueryCompatibleUnits returns all available blood units a recipient of the given blood type can receive
+func (s *BloodDonationChaincode) QueryCompatibleUnits(ctx contractapi.TransactionContextInterface, recipientBloodType string) ([]*BloodUnit, error) {
+    donorTypes, err := getCompatibleDonorTypes(recipientBloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":   "bloodUnit",
+        "bloodType": map[string]interface{}{"$in": donorTypes},
+        "status":    map[string]interface{}{"$in": availableStatuses},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var compatibleUnits []*BloodUnit
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        compatibleUnits = append(compatibleUnits, &bloodUnit)
+    }
+
+    return compatibleUnits, nil
+}
+
+// FindAvailableForEmergency selects compatible available units for an emergency request, exact
+// blood type matches first and then substitutes, until the required quantity is covered
+func (s *BloodDonationChaincode) FindAvailableForEmergency(ctx contractapi.TransactionContextInterface, bloodType string, requiredQuantity int) (*EmergencyMatch, error) {
+    if requiredQuantity <= 0 {
+        return nil, fmt.Errorf("Quantity must be greater than zero, got %d", requiredQuantity)
+    }
+
+    donorTypes, err := getCompatibleDonorTypes(bloodType)
+    if err != nil {
+        return nil, err
+    }
+    candidates, err := s.QueryCompatibleUnits(ctx, bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    currentDate := now.Format(dateTimeFormat)
+
+    // The recipient's own type is last in the compatibility list and the universal donor first,
+    // so the reverse list position gives exact matches first and saves O- for last
+    priority := make(map[string]int)
+    for i, donorType := range donorTypes {
+        priority[donorType] = len(donorTypes) - 1 - i
+    }
+    sort.SliceStable(candidates, func(i, j int) bool {
+        if priority[candidates[i].BloodType] != priority[candidates[j].BloodType] {
+            return priority[candidates[i].BloodType] < priority[candidates[j].BloodType]
+        }
+        return candidates[i].ExpiryDate < candidates[j].ExpiryDate
+    })
+
+    match := EmergencyMatch{Units: []*EmergencyUnit{}}
+    for _, bloodUnit := range candidates {
+        if match.TotalQuantity >= requiredQuantity {
+            break
+        }
+        // Skip units that are already past their expiry date
+        if bloodUnit.ExpiryDate != "" && bloodUnit.ExpiryDate < currentDate {
+            continue
+        }
+        match.Units = append(match.Units, &EmergencyUnit{
+            UnitID:       bloodUnit.UnitID,
+            BloodType:    bloodUnit.BloodType,
+            HospitalName: bloodUnit.HospitalName,
+            Quantity:     bloodUnit.Quantity,
+        })
+        match.TotalQuantity += bloodUnit.Quantity
+    }
+
+    if match.TotalQuantity < requiredQuantity {
+        match.Shortfall = requiredQuantity - match.TotalQuantity
+    }
+    return &match, nil
+}
+
+// QueryQuarantinedUnits returns all blood units still waiting for a lab result
+func (s *BloodDonationChaincode) QueryQuarantinedUnits(ctx contractapi.TransactionContextInterface) ([]*BloodUnit, error) {
+    return s.QueryUnitsByStatus(ctx, "Quarantined")
+}
+
+// QueryUnitsByStatus returns all blood units currently in the given status
+func (s *BloodDonationChaincode) QueryUnitsByStatus(ctx contractapi.TransactionContextInterface, status string) ([]*BloodUnit, error) {
+    queryString, err := buildStatusQuery(status)
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var units []*BloodUnit
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        units = append(units, &bloodUnit)
+    }
+
+    return units, nil
+}
+
+// QueryUnitsByStatusWithMetadata is QueryUnitsByStatus one page at a time, returning the query metadata as well
+func (s *BloodDonationChaincode) QueryUnitsByStatusWithMetadata(ctx contractapi.TransactionContextInterface, status string, pageSize int32, bookmark string) (*BloodUnitPage, error) {
+    queryString, err := buildStatusQuery(status)
+    if err != nil {
+        return nil, err
+    }
+    return queryBloodUnitPage(ctx, queryString, pageSize, bookmark)
+}
+
+// buildStatusQuery builds the rich query for the blood units in a status
+func buildStatusQuery(status string) (string, error) {
+    if !isValidBloodUnitStatus(status) {
+        return "", fmt.Errorf("Invalid blood unit status %s", status)
+    }
+    return buildSelectorQuery(map[string]interface{}{
+        "docType": "bloodUnit",
+        "status":  status,
+    })
+}
+
+// QueryDirectedUnitsAwaitingPatient returns the directed donations that have not been dispensed to
+// their patient or taken out of stock yet
+func (s *BloodDonationChaincode) QueryDirectedUnitsAwaitingPatient(ctx contractapi.TransactionContextInterface) ([]*BloodUnit, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":           "bloodUnit",
+        "directedPatientID": map[string]interface{}{"$gt": ""},
+        "status":            map[string]interface{}{"$in": []string{"Collected", "Quarantined", "Tested", "Available", "Reserved", "Partially Used"}},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    return collectResults[BloodUnit](resultsIterator)
+}
+
+// QueryUnitsCollectedOnDate returns the blood units collected on a calendar day, given in dateFormat,
+// ordered by collection time. Used for daily reconciliation.
+func (s *BloodDonationChaincode) QueryUnitsCollectedOnDate(ctx contractapi.TransactionContextInterface, date string) ([]*BloodUnit, error) {
+    day, err := time.Parse(dateFormat, date)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid date %s, expected format %s", date, dateFormat)
+    }
+
+    // The range runs up to the next midnight to take in the whole of 23:59:59
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType": "bloodUnit",
+        "collectedAt": map[string]interface{}{
+            "$gte": formatTimestamp(day),
+            "$lt":  formatTimestamp(day.AddDate(0, 0, 1)),
+        },
+    })
+    if err != nil {
+        return nil, err
+    }
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    bloodUnits, err := collectResults[BloodUnit](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    sort.Slice(bloodUnits, func(i, j int) bool {
+        if bloodUnits[i].Date != bloodUnits[j].Date {
+            return bloodUnits[i].Date < bloodUnits[j].Date
+        }
+        return bloodUnits[i].UnitID < bloodUnits[j].UnitID
+    })
+    return bloodUnits, nil
+}
+
+// QueryExpiredUnits returns all blood units whose expiry date is before the transaction timestamp
+func (s *BloodDonationChaincode) QueryExpiredUnits(ctx contractapi.TransactionContextInterface) ([]*BloodUnit, error) {
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "expiresAt": map[string]interface{}{"$gt": "", "$lt": formatTimestamp(now)}, // A unit without a timestamp is not expired
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var expiredUnits []*BloodUnit
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        expiredUnits = append(expiredUnits, &bloodUnit)
+    }
+
+    return expiredUnits, nil
+}
+
+// ExpireStaleUnits moves every tested, dispensable or reserved unit whose expiry date has passed to "Expired",
+// so expired stock no longer looks usable, and returns the IDs of the units it expired
+func (s *BloodDonationChaincode) ExpireStaleUnits(ctx contractapi.TransactionContextInterface) ([]string, error) {
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "status":     map[string]interface{}{"$in": append([]string{"Tested", "Reserved"}, availableStatuses...)},
+        "expiresAt": map[string]interface{}{"$gt": "", "$lt": formatTimestamp(now)}, // A unit without a timestamp is not expired
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    expiredUnitIDs := []string{}
+    deltas := make(map[string]*InventorySummary)
+    var expiryEvents []UnitStatusEvent
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+
+        // An expired unit can no longer honour its reservation
+        before := bloodUnit
+        err = setUnitStatus(&bloodUnit, "Expired")
+        if err != nil {
+            return nil, err
+        }
+        bloodUnit.ReservedBy = ""
+        bloodUnit.ReservedQuantity = 0
+
+        err = putBloodUnit(ctx, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        trackInventoryChange(deltas, &before, &bloodUnit)
+
+        expiredUnitIDs = append(expiredUnitIDs, bloodUnit.UnitID)
+        expiryEvents = append(expiryEvents, UnitStatusEvent{
+            UnitID:    bloodUnit.UnitID,
+            BloodType: bloodUnit.BloodType,
+            Status:    bloodUnit.Status,
+            Reason:    fmt.Sprintf("Expired on %s", bloodUnit.ExpiryDate),
+        })
+    }
+
+    err = updateInventoryCache(ctx, deltas)
+    if err != nil {
+        return nil, err
+    }
+
+    // Fabric keeps a single event per transaction, so all expired units go into one event
+    if len(expiryEvents) > 0 {
+        err = emitEvent(ctx, "UnitsExpired", expiryEvents)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return expiredUnitIDs, nil
+}
+
+// BackfillTimestamps fills in the RFC 3339 timestamps on blood units and usage history recorded before
+// those fields existed, deriving them from the stored dates, which were always written in UTC. Range
+// queries only find records that carry the timestamps, so submit it once after upgrading. Returns the
+// number of records updated.
+func (s *BloodDonationChaincode) BackfillTimestamps(ctx contractapi.TransactionContextInterface) (int, error) {
+    // A timestamp is missing if the field is absent or, for units rewritten before putBloodUnit filled
+    // it in, stored empty
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType": "bloodUnit",
+        "$or": []interface{}{
+            map[string]interface{}{"collectedAt": map[string]interface{}{"$exists": false}},
+            map[string]interface{}{"collectedAt": ""},
+            map[string]interface{}{"expiresAt": ""},
+        },
+    })
+    if err != nil {
+        return 0, err
+    }
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return 0, err
+    }
+    bloodUnits, err := collectResults[BloodUnit](resultsIterator)
+    if err != nil {
+        return 0, err
+    }
+
+    updated := 0
+    for _, bloodUnit := range bloodUnits {
+        // putBloodUnit fills in the missing timestamps
+        err = putBloodUnit(ctx, bloodUnit)
+        if err != nil {
+            return 0, err
+        }
+        updated++
+    }
+
+    // Usage history lives under composite keys, so keep each key to write the entry back
+    queryString, err = buildSelectorQuery(map[string]interface{}{
+        "docType": "usageHistory",
+        "$or": []interface{}{
+            map[string]interface{}{"usedAt": map[string]interface{}{"$exists": false}},
+            map[string]interface{}{"usedAt": ""},
+        },
+    })
+    if err != nil {
+        return 0, err
+    }
+    historyIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return 0, err
+    }
+    defer historyIterator.Close()
+
+    for historyIterator.HasNext() {
+        queryResponse, err := historyIterator.Next()
+        if err != nil {
+            return 0, err
+        }
+
+        var usageHistory UsageHistory
+        err = json.Unmarshal(queryResponse.Value, &usageHistory)
+        if err != nil {
+            return 0, err
+        }
+        used, err := time.Parse(dateTimeFormat, usageHistory.Date)
+        if err != nil {
+            return 0, fmt.Errorf("Usage history of blood unit %s has an invalid date %s", usageHistory.UnitID, usageHistory.Date)
+        }
+        usageHistory.UsedAt = formatTimestamp(used)
+
+        historyBytes, err := json.Marshal(usageHistory)
+        if err != nil {
+            return 0, err
+        }
+        err = putState(ctx, queryResponse.Key, historyBytes)
+        if err != nil {
+            return 0, err
+        }
+        updated++
+    }
+
+    return updated, nil
+}
+
+// GetInventorySummary returns the total available quantity and unit count per blood type,
+// counting only units that are available for dispensing and tested safe. Without recompute the
+// cached summary is returned, which is cheap but only as fresh as the last committed write.
+// With recompute every available unit is scanned, and when submitted as a transaction the
+// result also replaces the cache, e.g. to seed it for units recorded before it existed.
+func (s *BloodDonationChaincode) GetInventorySummary(ctx contractapi.TransactionContextInterface, recompute bool) ([]*InventorySummary, error) {
+    if !recompute {
+        inventory, err := getCachedInventory(ctx)
+        if err != nil {
+            return nil, err
+        }
+        if inventory != nil {
+            return inventory, nil
+        }
+    }
+
+    inventory, err := computeInventorySummary(ctx)
+    if err != nil {
+        return nil, err
+    }
+    err = putInventorySummaries(ctx, inventory)
+    if err != nil {
+        return nil, err
+    }
+    return inventory, nil
+}
+
+// computeInventorySummary scans every available, tested-safe unit and totals it per blood type
+func computeInventorySummary(ctx contractapi.TransactionContextInterface) ([]*InventorySummary, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "status":     map[string]interface{}{"$in": availableStatuses},
+        "testResult": "Safe",
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    summaryByType := make(map[string]*InventorySummary)
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+
+        summary, ok := summaryByType[bloodUnit.BloodType]
+        if !ok {
+            summary = &InventorySummary{BloodType: bloodUnit.BloodType}
+            summaryByType[bloodUnit.BloodType] = summary
+        }
+        summary.TotalQuantity += bloodUnit.Quantity
+        summary.UnitCount++
+    }
+
+    // Sort by blood type so every peer returns the same order
+    inventory := []*InventorySummary{}
+    for _, summary := range summaryByType {
+        inventory = append(inventory, summary)
+    }
+    sort.Slice(inventory, func(i, j int) bool {
+        return inventory[i].BloodType < inventory[j].BloodType
+    })
+
+    return inventory, nil
+}
+
+// getInventoryCache reads the cached inventory summary of a blood type, returning nil if it has never been
+// written or was computed under an older inventoryCacheVersion
+func getInventoryCache(ctx contractapi.TransactionContextInterface, bloodType string) (*InventoryCache, error) {
+    cacheKey, err := ctx.GetStub().CreateCompositeKey("inventoryCache", []string{bloodType})
+    if err != nil {
+        return nil, err
+    }
+    cacheBytes, err := getState(ctx, cacheKey)
+    if err != nil {
+        return nil, err
+    }
+    if cacheBytes == nil {
+        return nil, nil
+    }
+
+    var inventoryCache InventoryCache
+    err = json.Unmarshal(cacheBytes, &inventoryCache)
+    if err != nil {
+        return nil, err
+    }
+    if inventoryCache.Version != inventoryCacheVersion {
+        return nil, nil
+    }
+    return &inventoryCache, nil
+}
+
+// putInventoryCache stores the summary of one blood type as its new cached value
+func putInventoryCache(ctx contractapi.TransactionContextInterface, summary InventorySummary) error {
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    cacheBytes, err := json.Marshal(InventoryCache{
+        DocType:   "inventoryCache",
+        Version:   inventoryCacheVersion,
+        Summary:   summary,
+        UpdatedAt: now.Format(dateTimeFormat),
+    })
+    if err != nil {
+        return err
+    }
+    cacheKey, err := ctx.GetStub().CreateCompositeKey("inventoryCache", []string{summary.BloodType})
+    if err != nil {
+        return err
+    }
+    return putState(ctx, cacheKey, cacheBytes)
+}
+
+// putInventorySummaries replaces the cache of every blood type with a computed inventory summary. Blood
+// types without stock get an empty summary, so a missing cache always means one was never computed.
+func putInventorySummaries(ctx contractapi.TransactionContextInterface, inventory []*InventorySummary) error {
+    summaryByType := make(map[string]*InventorySummary)
+    for _, summary := range inventory {
+        summaryByType[summary.BloodType] = summary
+    }
+    for _, bloodType := range sortedBloodTypes() {
+        summary := InventorySummary{BloodType: bloodType}
+        if computed, ok := summaryByType[bloodType]; ok {
+            summary = *computed
+        }
+        err := putInventoryCache(ctx, summary)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// getCachedInventory reads the cached summaries of the blood types that have stock, sorted by blood
+// type, returning nil when the cache of any blood type has not been computed
+func getCachedInventory(ctx contractapi.TransactionContextInterface) ([]*InventorySummary, error) {
+    inventory := []*InventorySummary{}
+    for _, bloodType := range sortedBloodTypes() {
+        inventoryCache, err := getInventoryCache(ctx, bloodType)
+        if err != nil {
+            return nil, err
+        }
+        if inventoryCache == nil {
+            return nil, nil
+        }
+        if inventoryCache.Summary.UnitCount > 0 {
+            summary := inventoryCache.Summary
+            inventory = append(inventory, &summary)
+        }
+    }
+    return inventory, nil
+}
+
+// trackInventoryChange adds the change in a unit's contribution to available stock to deltas,
+// keyed by blood type. before is nil for a unit created by the write.
+func trackInventoryChange(deltas map[string]*InventorySummary, before *BloodUnit, after *BloodUnit) {
+    addInventoryContribution(deltas, before, -1)
+    addInventoryContribution(deltas, after, 1)
+}
+
+// addInventoryContribution adds or, with sign -1, removes a unit's share of available stock in deltas
+func addInventoryContribution(deltas map[string]*InventorySummary, bloodUnit *BloodUnit, sign int) {
+    if bloodUnit == nil || !isAvailableStatus(bloodUnit.Status) || bloodUnit.TestResult != "Safe" {
+        return
+    }
+    delta, ok := deltas[bloodUnit.BloodType]
+    if !ok {
+        delta = &InventorySummary{BloodType: bloodUnit.BloodType}
+        deltas[bloodUnit.BloodType] = delta
+    }
+    delta.TotalQuantity += sign * bloodUnit.Quantity
+    delta.UnitCount += sign
+}
+
+// updateInventoryCache applies the tracked stock changes of a transaction to the cached inventory
+// summaries. Reads do not see writes made earlier in the same transaction, so a transaction must
+// collect all of its changes and call this once. The cache of a blood type is left alone until it
+// has been computed, since adjusting a missing summary would undercount the existing stock.
+func updateInventoryCache(ctx contractapi.TransactionContextInterface, deltas map[string]*InventorySummary) error {
+    // Only the blood types whose stock changed are read and written, in a fixed order
+    var bloodTypes []string
+    for bloodType, delta := range deltas {
+        if delta.TotalQuantity != 0 || delta.UnitCount != 0 {
+            bloodTypes = append(bloodTypes, bloodType)
+        }
+    }
+    sort.Strings(bloodTypes)
+
+    for _, bloodType := range bloodTypes {
+        inventoryCache, err := getInventoryCache(ctx, bloodType)
+        if err != nil {
+            return err
+        }
+        if inventoryCache == nil {
+            continue
+        }
+
+        summary := inventoryCache.Summary
+        summary.TotalQuantity += deltas[bloodType].TotalQuantity
+        summary.UnitCount += deltas[bloodType].UnitCount
+        err = putInventoryCache(ctx, summary)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// GetBloodUnitCountByStatus returns how many blood units are in each status
+func (s *BloodDonationChaincode) GetBloodUnitCountByStatus(ctx contractapi.TransactionContextInterface) ([]*StatusCount, error) {
+    queryString := `{"selector":{"docType":"bloodUnit"}}`
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    // Start every known status at zero so the report always lists the full lifecycle
+    var statusCounts []*StatusCount
+    countByStatus := make(map[string]*StatusCount)
+    for _, status := range bloodUnitStatuses {
+        statusCount := &StatusCount{Status: status}
+        countByStatus[status] = statusCount
+        statusCounts = append(statusCounts, statusCount)
+    }
+
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+
+        // Statuses outside the known lifecycle are still counted rather than dropped
+        statusCount, ok := countByStatus[bloodUnit.Status]
+        if !ok {
+            statusCount = &StatusCount{Status: bloodUnit.Status}
+            countByStatus[bloodUnit.Status] = statusCount
+            statusCounts = append(statusCounts, statusCount)
+        }
+        statusCount.Count++
+    }
+
+    return statusCounts, nil
+}
+
+// GetDonationStatistics reports the number of donors, units collected, used and wasted, overall and
+// per blood type. A unit counts as wasted when it is unsafe, disposed or past its expiry date without
+// having been used. Only collected units are counted, not the components or transfers split off them.
+// Both the donor and blood unit record sets are scanned in full, so the cost grows with the ledger
+// and this is meant for occasional administrative reports rather than routine transactions.
+func (s *BloodDonationChaincode) GetDonationStatistics(ctx contractapi.TransactionContextInterface) (*DonationStatistics, error) {
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    currentDate := now.Format(dateTimeFormat)
+
+    var statistics DonationStatistics
+
+    donorIterator, err := ctx.GetStub().GetQueryResult(`{"selector":{"docType":"donor"}}`)
+    if err != nil {
+        return nil, err
+    }
+    defer donorIterator.Close()
+
+    for donorIterator.HasNext() {
+        _, err := donorIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+        statistics.TotalDonors++
+    }
+
+    unitIterator, err := ctx.GetStub().GetQueryResult(`{"selector":{"docType":"bloodUnit"}}`)
+    if err != nil {
+        return nil, err
+    }
+    defer unitIterator.Close()
+
+    statisticsByType := make(map[string]*BloodTypeStatistics)
+    for unitIterator.HasNext() {
+        queryResponse, err := unitIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+
+        // Units split off a donation (components, partial transfers) are not collections themselves
+        if bloodUnit.ParentUnitID != "" {
+            continue
+        }
+
+        typeStatistics, ok := statisticsByType[bloodUnit.BloodType]
+        if !ok {
+            typeStatistics = &BloodTypeStatistics{BloodType: bloodUnit.BloodType}
+            statisticsByType[bloodUnit.BloodType] = typeStatistics
+        }
+
+        typeStatistics.UnitsCollected++
+        statistics.TotalUnitsCollected++
+
+        expired := bloodUnit.ExpiryDate != "" && bloodUnit.ExpiryDate < currentDate
+        switch {
+        case bloodUnit.Status == "Used":
+            typeStatistics.UnitsUsed++
+            statistics.TotalUnitsUsed++
+        case bloodUnit.Status == "Unsafe" || bloodUnit.Status == "Disposed" || bloodUnit.Status == "Expired" || expired:
+            typeStatistics.UnitsWasted++
+            statistics.TotalUnitsWasted++
+        }
+    }
+
+    if statistics.TotalUnitsCollected > 0 {
+        statistics.WastageRate = float64(statistics.TotalUnitsWasted) / float64(statistics.TotalUnitsCollected)
+    }
+
+    for _, typeStatistics := range statisticsByType {
+        statistics.ByBloodType = append(statistics.ByBloodType, typeStatistics)
+    }
+    sort.Slice(statistics.ByBloodType, func(i, j int) bool {
+        return statistics.ByBloodType[i].BloodType < statistics.ByBloodType[j].BloodType
+    })
+
+    return &statistics, nil
+}
+
+// GetHospitalInventory returns the available stock held by one acceptor, broken down by blood type
+func (s *BloodDonationChaincode) GetHospitalInventory(ctx contractapi.TransactionContextInterface, acceptorID string) ([]*InventorySummary, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "acceptorID": acceptorID,
+        "status":     map[string]interface{}{"$in": availableStatuses},
+        "testResult": "Safe",
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    summaryByType := make(map[string]*InventorySummary)
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+
+        summary, ok := summaryByType[bloodUnit.BloodType]
+        if !ok {
+            summary = &InventorySummary{BloodType: bloodUnit.BloodType}
+            summaryByType[bloodUnit.BloodType] = summary
+        }
+        summary.TotalQuantity += bloodUnit.Quantity
+        summary.UnitCount++
+    }
+
+    var inventory []*InventorySummary
+    for _, summary := range summaryByType {
+        inventory = append(inventory, summary)
+    }
+    sort.Slice(inventory, func(i, j int) bool {
+        return inventory[i].BloodType < inventory[j].BloodType
+    })
+
+    return inventory, nil
+}
+
+// QueryUnitsExpiringWithin returns available units that expire within the next given number of days,
+// soonest expiry first, so near-expiry stock can be used before it goes to waste
+func (s *BloodDonationChaincode) QueryUnitsExpiringWithin(ctx contractapi.TransactionContextInterface, days int) ([]*BloodUnit, error) {
+    if days < 0 {
+        return nil, fmt.Errorf("Days must not be negative, got %d", days)
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "status":     map[string]interface{}{"$in": availableStatuses},
+        "testResult": "Safe",
+        "expiresAt": map[string]interface{}{
+            "$gte": formatTimestamp(now),
+            "$lte": formatTimestamp(now.AddDate(0, 0, days)),
+        },
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var expiringUnits []*BloodUnit
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        expiringUnits = append(expiringUnits, &bloodUnit)
+    }
+
+    // First to expire, first out
+    sort.SliceStable(expiringUnits, func(i, j int) bool {
+        return expiringUnits[i].ExpiryDate < expiringUnits[j].ExpiryDate
+    })
+
+    return expiringUnits, nil
+}
+
+// GetUnusedExpiringValue forecasts wastage: the volume and estimated value of available units expiring
+// within the given number of days, per hospital, so the stock at greatest risk can be used first
+func (s *BloodDonationChaincode) GetUnusedExpiringValue(ctx contractapi.TransactionContextInterface, days int) (*WastageForecast, error) {
+    report, err := s.GetExpiringDonationsReport(ctx, days)
+    if err != nil {
+        return nil, err
+    }
+
+    forecast := WastageForecast{
+        Days:              days,
+        CostPerMilliliter: costPerMilliliter,
+        ByHospital:        []*HospitalWastage{},
+    }
+    for hospitalName, bloodUnits := range report {
+        hospitalWastage := &HospitalWastage{HospitalName: hospitalName}
+        for _, bloodUnit := range bloodUnits {
+            hospitalWastage.UnitCount++
+            hospitalWastage.TotalQuantity += bloodUnit.Quantity
+        }
+        hospitalWastage.EstimatedValue = float64(hospitalWastage.TotalQuantity) * costPerMilliliter
+
+        forecast.UnitCount += hospitalWastage.UnitCount
+        forecast.TotalQuantity += hospitalWastage.TotalQuantity
+        forecast.ByHospital = append(forecast.ByHospital, hospitalWastage)
+    }
+    forecast.EstimatedValue = float64(forecast.TotalQuantity) * costPerMilliliter
+
+    // Map iteration order is random, so break ties by name to keep every peer's result identical
+    sort.Slice(forecast.ByHospital, func(i, j int) bool {
+        if forecast.ByHospital[i].TotalQuantity != forecast.ByHospital[j].TotalQuantity {
+            return forecast.ByHospital[i].TotalQuantity > forecast.ByHospital[j].TotalQuantity
+        }
+        return forecast.ByHospital[i].HospitalName < forecast.ByHospital[j].HospitalName
+    })
+
+    return &forecast, nil
+}
+
+// GetExpiringDonationsReport groups the available units expiring within the given number of days
+// by the hospital holding them, each list ordered first to expire first, so every facility can be
+// sent its own at-risk stock
+func (s *BloodDonationChaincode) GetExpiringDonationsReport(ctx contractapi.TransactionContextInterface, days int) (map[string][]*BloodUnit, error) {
+    expiringUnits, err := s.QueryUnitsExpiringWithin(ctx, days)
+    if err != nil {
+        return nil, err
+    }
+
+    report := make(map[string][]*BloodUnit)
+    for _, bloodUnit := range expiringUnits {
+        report[bloodUnit.HospitalName] = append(report[bloodUnit.HospitalName], bloodUnit)
+    }
+
+    return report, nil
+}
+
+// SetLowStockThreshold stores the level below which a blood type is considered low on stock
+func (s *BloodDonationChaincode) SetLowStockThreshold(ctx contractapi.TransactionContextInterface, bloodType string, threshold int) error {
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return err
+    }
+    if threshold < 0 {
+        return fmt.Errorf("Threshold must not be negative, got %d", threshold)
+    }
+
+    lowStockThreshold := LowStockThreshold{
+        DocType:   "lowStockThreshold",
+        BloodType: bloodType,
+        Threshold: threshold,
+    }
+    thresholdBytes, err := json.Marshal(lowStockThreshold)
+    if err != nil {
+        return err
+    }
+    thresholdKey, err := ctx.GetStub().CreateCompositeKey("lowStockThreshold", []string{bloodType})
+    if err != nil {
+        return err
+    }
+    return putState(ctx, thresholdKey, thresholdBytes)
+}
+
+// SetReserveFloor stores the stock level of a blood type below which only emergency requests are dispensed
+func (s *BloodDonationChaincode) SetReserveFloor(ctx contractapi.TransactionContextInterface, bloodType string, floor int) error {
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return err
+    }
+    if floor < 0 {
+        return fmt.Errorf("Reserve floor must not be negative, got %d", floor)
+    }
+
+    reserveFloor := ReserveFloor{
+        DocType:   "reserveFloor",
+        BloodType: bloodType,
+        Floor:     floor,
+    }
+    floorBytes, err := json.Marshal(reserveFloor)
+    if err != nil {
+        return err
+    }
+    floorKey, err := ctx.GetStub().CreateCompositeKey("reserveFloor", []string{bloodType})
+    if err != nil {
+        return err
+    }
+    return putState(ctx, floorKey, floorBytes)
+}
+
+// getAvailableQuantity returns the total committed quantity of safe, dispensable units of a blood type
+func getAvailableQuantity(ctx contractapi.TransactionContextInterface, bloodType string) (int, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "bloodType":  bloodType,
+        "status":     map[string]interface{}{"$in": availableStatuses},
+        "testResult": "Safe",
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return 0, err
+    }
+    defer resultsIterator.Close()
+
+    totalQuantity := 0
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return 0, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return 0, err
+        }
+        totalQuantity += bloodUnit.Quantity
+    }
+
+    return totalQuantity, nil
+}
+
+// RecordCrossMatch records the result of cross-matching a blood unit against a patient before transfusion.
+// Every cross-match is kept, the most recent one for a unit and patient decides whether it may be dispensed.
+func (s *BloodDonationChaincode) RecordCrossMatch(ctx contractapi.TransactionContextInterface, unitID string, patientID string, result string) error {
+    err := checkLabAccess(ctx)
+    if err != nil {
+        return err
+    }
+
+    if strings.TrimSpace(patientID) == "" {
+        return fmt.Errorf("A patient ID is required")
+    }
+    if result != "Compatible" && result != "Incompatible" {
+        return fmt.Errorf("Invalid cross-match result %s, must be Compatible or Incompatible", result)
+    }
+
+    _, err = getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+
+    crossMatch := CrossMatch{
+        DocType:    "crossMatch",
+        UnitID:     unitID,
+        PatientID:  patientID,
+        Result:     result,
+        Date:       now.Format(dateTimeFormat),
+        RecordedBy: recordedBy,
+    }
+    crossMatchBytes, err := json.Marshal(crossMatch)
+    if err != nil {
+        return err
+    }
+    // Key cross-matches by unit, patient and transaction so repeated cross-matches never collide
+    crossMatchKey, err := ctx.GetStub().CreateCompositeKey("crossMatch", []string{unitID, patientID, ctx.GetStub().GetTxID()})
+    if err != nil {
+        return err
+    }
+    return putState(ctx, crossMatchKey, crossMatchBytes)
+}
+
+// QueryCrossMatchesByUnit returns every cross-match recorded for a blood unit, oldest first
+func (s *BloodDonationChaincode) QueryCrossMatchesByUnit(ctx contractapi.TransactionContextInterface, unitID string) ([]*CrossMatch, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("crossMatch", []string{unitID})
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var crossMatches []*CrossMatch
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var crossMatch CrossMatch
+        err = json.Unmarshal(queryResponse.Value, &crossMatch)
+        if err != nil {
+            return nil, err
+        }
+        crossMatches = append(crossMatches, &crossMatch)
+    }
+
+    sort.SliceStable(crossMatches, func(i, j int) bool {
+        return crossMatches[i].Date < crossMatches[j].Date
+    })
+
+    return crossMatches, nil
+}
+
+// LogTemperature records a storage temperature reading for a blood unit. A reading outside the safe
+// range for the unit's component type flags the unit with a temperature excursion.
+func (s *BloodDonationChaincode) LogTemperature(ctx contractapi.TransactionContextInterface, unitID string, celsius float64) error {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    componentType := bloodUnit.ComponentType
+    if componentType == "" {
+        componentType = "Whole Blood"
+    }
+    storageRange, ok := componentStorageRanges[componentType]
+    if !ok {
+        return fmt.Errorf("No storage temperature range is defined for component type %s", componentType)
+    }
+
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+
+    reading := TemperatureReading{
+        DocType:    "temperatureReading",
+        UnitID:     unitID,
+        Celsius:    celsius,
+        Excursion:  celsius < storageRange.MinCelsius || celsius > storageRange.MaxCelsius,
+        Date:       now.Format(dateTimeFormat),
+        RecordedBy: recordedBy,
+    }
+    readingBytes, err := json.Marshal(reading)
+    if err != nil {
+        return err
+    }
+    readingKey, err := ctx.GetStub().CreateCompositeKey("temperatureReading", []string{unitID, ctx.GetStub().GetTxID()})
+    if err != nil {
+        return err
+    }
+    err = putState(ctx, readingKey, readingBytes)
+    if err != nil {
+        return err
+    }
+
+    // The flag is only ever raised, a later reading back in range does not undo the excursion
+    if !reading.Excursion || bloodUnit.TemperatureExcursion {
+        return nil
+    }
+    bloodUnit.TemperatureExcursion = true
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    return emitEvent(ctx, "TemperatureExcursion", UnitStatusEvent{
+        UnitID:    unitID,
+        BloodType: bloodUnit.BloodType,
+        Status:    bloodUnit.Status,
+        Reason:    fmt.Sprintf("Stored at %.1f°C, safe range for %s is %.0f to %.0f°C", celsius, componentType, storageRange.MinCelsius, storageRange.MaxCelsius),
+    })
+}
+
+// QueryTemperatureLog returns every temperature reading logged for a blood unit, oldest first
+func (s *BloodDonationChaincode) QueryTemperatureLog(ctx contractapi.TransactionContextInterface, unitID string) ([]*TemperatureReading, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("temperatureReading", []string{unitID})
+    if err != nil {
+        return nil, err
+    }
+    readings, err := collectResults[TemperatureReading](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    sort.SliceStable(readings, func(i, j int) bool {
+        return readings[i].Date < readings[j].Date
+    })
+    return readings, nil
+}
+
+// hasCompatibleCrossMatch checks whether the most recent cross-match of a unit against a patient was compatible
+func hasCompatibleCrossMatch(ctx contractapi.TransactionContextInterface, unitID string, patientID string) (bool, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("crossMatch", []string{unitID, patientID})
+    if err != nil {
+        return false, err
+    }
+    defer resultsIterator.Close()
+
+    var latest *CrossMatch
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return false, err
+        }
+
+        var crossMatch CrossMatch
+        err = json.Unmarshal(queryResponse.Value, &crossMatch)
+        if err != nil {
+            return false, err
+        }
+        if latest == nil || crossMatch.Date >= latest.Date {
+            latest = &crossMatch
+        }
+    }
+
+    return latest != nil && latest.Result == "Compatible", nil
+}
+
+// getStockLimits reads the reserve floor and low-stock threshold configured for a blood type,
+// either is nil when none has been set
+func getStockLimits(ctx contractapi.TransactionContextInterface, bloodType string) (*ReserveFloor, *LowStockThreshold, error) {
+    floorKey, err := ctx.GetStub().CreateCompositeKey("reserveFloor", []string{bloodType})
+    if err != nil {
+        return nil, nil, err
+    }
+    floorBytes, err := getState(ctx, floorKey)
+    if err != nil {
+        return nil, nil, err
+    }
+    thresholdKey, err := ctx.GetStub().CreateCompositeKey("lowStockThreshold", []string{bloodType})
+    if err != nil {
+        return nil, nil, err
+    }
+    thresholdBytes, err := getState(ctx, thresholdKey)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var reserveFloor *ReserveFloor
+    if floorBytes != nil {
+        reserveFloor = &ReserveFloor{}
+        err = json.Unmarshal(floorBytes, reserveFloor)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    var lowStockThreshold *LowStockThreshold
+    if thresholdBytes != nil {
+        lowStockThreshold = &LowStockThreshold{}
+        err = json.Unmarshal(thresholdBytes, lowStockThreshold)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    return reserveFloor, lowStockThreshold, nil
+}
+
+// checkReserveFloor refuses a dispense that would leave a blood type's stock at currentLevel, below its
+// reserve floor, unless emergencyOverride is set. An override is recorded in the event log, and the
+// result reports whether it was needed.
+func checkReserveFloor(ctx contractapi.TransactionContextInterface, reserveFloor *ReserveFloor, overrideEvent EmergencyOverrideEvent, emergencyOverride bool) (bool, error) {
+    if reserveFloor == nil || overrideEvent.CurrentLevel >= reserveFloor.Floor {
+        return false, nil
+    }
+    if !emergencyOverride {
+        return false, fmt.Errorf("Dispensing %d mL would drop %s stock to %d mL, below its reserve floor of %d mL; use the emergency override for emergency requests",
+            overrideEvent.Quantity, overrideEvent.BloodType, overrideEvent.CurrentLevel, reserveFloor.Floor)
+    }
+    overrideEvent.Floor = reserveFloor.Floor
+    err := appendEventLog(ctx, "EmergencyOverride", overrideEvent)
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// putUsageHistory stores a usage history entry, keyed by unit and transaction so entries never
+// collide and can be looked up per unit
+func putUsageHistory(ctx contractapi.TransactionContextInterface, usageHistory UsageHistory) error {
+    historyBytes, err := json.Marshal(usageHistory)
+    if err != nil {
+        return err
+    }
+    historyKey, err := ctx.GetStub().CreateCompositeKey("usageHistory", []string{usageHistory.UnitID, ctx.GetStub().GetTxID()})
+    if err != nil {
+        return err
+    }
+    return putState(ctx, historyKey, historyBytes)
+}
+
+// AcceptBlood function to update the status of a blood unit when accepted by a hospital for a patient,
+// returning what was dispensed and the resulting state of the unit. The unit must have been
+// cross-matched as compatible with the patient. Stock below the blood type's reserve floor is
+// only dispensed with emergencyOverride set. idempotencyKey is optional: a retry with the same key and
+// arguments returns the original result without dispensing again, pass an empty string to go without.
+func (s *BloodDonationChaincode) AcceptBlood(ctx contractapi.TransactionContextInterface, unitID string, acceptorID string, patientID string, quantity int, emergencyOverride bool, idempotencyKey string) (*AcceptResult, error) {
+    args := []interface{}{unitID, acceptorID, patientID, quantity, emergencyOverride}
+    processed, err := getProcessedRequest(ctx, "AcceptBlood", idempotencyKey, args)
+    if err != nil {
+        return nil, err
+    }
+    if processed != nil {
+        var result AcceptResult
+        err = json.Unmarshal(processed.Result, &result)
+        if err != nil {
+            return nil, err
+        }
+        return &result, nil
+    }
+
+    result, err := acceptBlood(ctx, unitID, acceptorID, patientID, quantity, emergencyOverride)
+    if err != nil {
+        return nil, err
+    }
+    err = putProcessedRequest(ctx, "AcceptBlood", idempotencyKey, args, result)
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+// acceptBlood dispenses from a blood unit for AcceptBlood, once any idempotency key has been checked
+func acceptBlood(ctx contractapi.TransactionContextInterface, unitID string, acceptorID string, patientID string, quantity int, emergencyOverride bool) (*AcceptResult, error) {
+    if quantity <= 0 {
+        return nil, fmt.Errorf("Quantity must be greater than zero, got %d", quantity)
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return nil, err
+    }
+
+    // Usage history must only ever reference registered hospitals
+    _, err = getAcceptor(ctx, acceptorID)
+    if err != nil {
+        return nil, err
+    }
+
+    // Dispensing is only permitted from the statuses listed here, every other status is refused
+    // with a reason so the caller knows why
+    switch bloodUnit.Status {
+    case "Available", "Partially Used":
+    case "Reserved":
+        // Other acceptors may only draw on the part of a reserved unit that is not held for the reservation
+        unreserved := bloodUnit.Quantity - bloodUnit.ReservedQuantity
+        if bloodUnit.ReservedBy != acceptorID && quantity > unreserved {
+            return nil, fmt.Errorf("Blood unit %s is reserved by %s, only %d mL is unreserved, requested %d", unitID, bloodUnit.ReservedBy, unreserved, quantity)
+        }
+    case "Collected", "Quarantined":
+        return nil, fmt.Errorf("Blood unit %s is awaiting its lab result and cannot be dispensed", unitID)
+    case "Tested":
+        return nil, fmt.Errorf("Blood unit %s has been tested but not made available yet", unitID)
+    case "Unsafe":
+        return nil, fmt.Errorf("Blood unit %s is unsafe and cannot be dispensed", unitID)
+    case "Used":
+        return nil, fmt.Errorf("Blood unit %s has been used up", unitID)
+    case "Separated":
+        return nil, fmt.Errorf("Blood unit %s has been separated into components, dispense a component instead", unitID)
+    case "Disposed":
+        return nil, fmt.Errorf("Blood unit %s was disposed of: %s", unitID, bloodUnit.DisposalReason)
+    case "Recalled":
+        return nil, fmt.Errorf("Blood unit %s has been recalled: %s", unitID, bloodUnit.RecallReason)
+    case "Rejected":
+        return nil, fmt.Errorf("Blood unit %s was rejected at intake: %s", unitID, bloodUnit.RejectionReason)
+    case "Expired":
+        return nil, fmt.Errorf("Blood unit %s expired on %s", unitID, bloodUnit.ExpiryDate)
+    default:
+        return nil, fmt.Errorf("Blood unit %s cannot be dispensed in status %s", unitID, bloodUnit.Status)
+    }
+
+    // Only screened-safe blood may leave inventory, whatever its status says
+    if bloodUnit.TestResult != "Safe" {
+        return nil, fmt.Errorf("Blood unit %s has not been tested safe and cannot be dispensed", unitID)
+    }
+    // Blood stored outside its safe temperature range may have degraded
+    if bloodUnit.TemperatureExcursion {
+        return nil, fmt.Errorf("Blood unit %s has a recorded temperature excursion and cannot be dispensed", unitID)
+    }
+
+    // Refuse to dispense a unit that is past its expiry date
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if bloodUnit.ExpiryDate != "" {
+        expiry, err := time.Parse(dateTimeFormat, bloodUnit.ExpiryDate)
+        if err != nil {
+            return nil, err
+        }
+        if expiry.Before(now) {
+            return nil, fmt.Errorf("Blood unit %s expired on %s", unitID, bloodUnit.ExpiryDate)
+        }
+    }
+
+    // Check if the quantity requested is available before touching any state
+    if bloodUnit.Quantity < quantity {
+        return nil, fmt.Errorf("Insufficient blood quantity available. Available: %d, Requested: %d", bloodUnit.Quantity, quantity)
+    }
+
+    // A directed donation is only ever given to the patient it was made for
+    if bloodUnit.DirectedPatientID != "" && bloodUnit.DirectedPatientID != patientID {
+        return nil, fmt.Errorf("Blood unit %s is a directed donation for patient %s", unitID, bloodUnit.DirectedPatientID)
+    }
+
+    // Never transfuse without a compatible cross-match against this patient
+    compatible, err := hasCompatibleCrossMatch(ctx, unitID, patientID)
+    if err != nil {
+        return nil, err
+    }
+    if !compatible {
+        return nil, fmt.Errorf("Blood unit %s has no compatible cross-match for patient %s", unitID, patientID)
+    }
+
+    // Remember how much this unit counted towards available stock before the change
+    previouslyAvailable := 0
+    if isAvailableStatus(bloodUnit.Status) && bloodUnit.TestResult == "Safe" {
+        previouslyAvailable = bloodUnit.Quantity
+    }
+
+    // Update the quantity of the blood unit. What the reserving acceptor draws comes out of its
+    // reservation first, the unit stays reserved until the reserved quantity has been drawn
+    before := *bloodUnit
+    bloodUnit.Quantity -= quantity
+    bloodUnit.DispensedQuantity += quantity
+    if bloodUnit.Status == "Reserved" && bloodUnit.ReservedBy == acceptorID {
+        bloodUnit.ReservedQuantity -= quantity
+        if bloodUnit.ReservedQuantity < 0 {
+            bloodUnit.ReservedQuantity = 0
+        }
+    }
+
+    // Automatically mark the blood unit as used if quantity is zero, the single PutState
+    // below persists the terminal status together with the zero quantity
+    newStatus := "Partially Used" // Indicate that some quantity is still available
+    if bloodUnit.Quantity == 0 {
+        newStatus = "Used"
+    } else if bloodUnit.Status == "Reserved" && bloodUnit.ReservedQuantity > 0 {
+        newStatus = "Reserved"
+    }
+    if newStatus != "Reserved" {
+        bloodUnit.ReservedBy = ""
+        bloodUnit.ReservedQuantity = 0
+    }
+    err = setUnitStatus(bloodUnit, newStatus)
+    if err != nil {
+        return nil, err
+    }
+
+    // Look up the reserve floor and low-stock threshold configured for this blood type
+    reserveFloor, lowStockThreshold, err := getStockLimits(ctx, bloodUnit.BloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    // Rich queries only see committed state, so swap in this unit's updated contribution
+    currentLevel := 0
+    if reserveFloor != nil || lowStockThreshold != nil {
+        currentLevel, err = getAvailableQuantity(ctx, bloodUnit.BloodType)
+        if err != nil {
+            return nil, err
+        }
+        currentLevel -= previouslyAvailable
+        if isAvailableStatus(bloodUnit.Status) {
+            currentLevel += bloodUnit.Quantity
+        }
+    }
+
+    // Stock below the reserve floor is held back for emergencies
+    overrideUsed, err := checkReserveFloor(ctx, reserveFloor, EmergencyOverrideEvent{
+        BloodType:    bloodUnit.BloodType,
+        UnitIDs:      []string{unitID},
+        AcceptorID:   acceptorID,
+        PatientID:    patientID,
+        Quantity:     quantity,
+        CurrentLevel: currentLevel,
+    }, emergencyOverride)
+    if err != nil {
+        return nil, err
+    }
+
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    // Record usage history
+    historyDate := now.Format(dateTimeFormat)
+    err = putUsageHistory(ctx, UsageHistory{
+        DocType:    "usageHistory",
+        UnitID:     unitID,
+        AcceptorID: acceptorID,
+        PatientID:  patientID,
+        Quantity:   quantity,
+        Date:       historyDate,
+        UsedAt:     formatTimestamp(now),
+        RecordedBy: recordedBy,
+        EmergencyOverride: overrideUsed,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return nil, err
+    }
+
+    deltas := make(map[string]*InventorySummary)
+    trackInventoryChange(deltas, &before, bloodUnit)
+    err = updateInventoryCache(ctx, deltas)
+    if err != nil {
+        return nil, err
+    }
+
+    result := &AcceptResult{
+        UnitID:            unitID,
+        QuantityDispensed: quantity,
+        RemainingQuantity: bloodUnit.Quantity,
+        NewStatus:         bloodUnit.Status,
+    }
+
+    acceptEvent := BloodEvent{
+        UnitID:     unitID,
+        BloodType:  bloodUnit.BloodType,
+        Quantity:   quantity,
+        AcceptorID: acceptorID,
+    }
+    err = appendEventLog(ctx, "BloodAccepted", acceptEvent)
+    if err != nil {
+        return nil, err
+    }
+
+    // Notify subscribed clients about the dispensed blood, unless the remaining stock for this blood
+    // type is below its low-stock threshold
+    if lowStockThreshold == nil || currentLevel >= lowStockThreshold.Threshold {
+        err = emitEvent(ctx, "BloodAccepted", acceptEvent)
+        if err != nil {
+            return nil, err
+        }
+        return result, nil
+    }
+
+    // Fabric keeps a single event per transaction, so LowStock is sent instead of BloodAccepted and
+    // carries the acceptance details along with the stock level
+    err = emitEvent(ctx, "LowStock", LowStockEvent{
+        BloodType:    bloodUnit.BloodType,
+        CurrentLevel: currentLevel,
+        Threshold:    lowStockThreshold.Threshold,
+        UnitID:       unitID,
+        AcceptorID:   acceptorID,
+        Quantity:     quantity,
+        Accepted:     []BloodEvent{acceptEvent},
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+// GetAvailableUnitsSortedByExpiry returns the dispensable units of a blood type, soonest to expire
+// first, so stock is used before it goes to waste
+func (s *BloodDonationChaincode) GetAvailableUnitsSortedByExpiry(ctx contractapi.TransactionContextInterface, bloodType string) ([]*BloodUnit, error) {
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "bloodUnit",
+        "bloodType":  bloodType,
+        "status":     map[string]interface{}{"$in": availableStatuses},
+        "testResult": "Safe",
+    })
+    if err != nil {
+        return nil, err
+    }
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    candidates, err := collectResults[BloodUnit](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    currentDate := now.Format(dateTimeFormat)
+
+    // Leave out units AcceptBlood would refuse anyway
+    bloodUnits := []*BloodUnit{}
+    for _, bloodUnit := range candidates {
+        if bloodUnit.ExpiryDate != "" && bloodUnit.ExpiryDate < currentDate {
+            continue
+        }
+        if bloodUnit.TemperatureExcursion || bloodUnit.Quantity <= 0 {
+            continue
+        }
+        bloodUnits = append(bloodUnits, bloodUnit)
+    }
+
+    sort.SliceStable(bloodUnits, func(i, j int) bool {
+        if bloodUnits[i].ExpiryDate != bloodUnits[j].ExpiryDate {
+            return bloodUnits[i].ExpiryDate < bloodUnits[j].ExpiryDate
+        }
+        return bloodUnits[i].UnitID < bloodUnits[j].UnitID
+    })
+    return bloodUnits, nil
+}
+
+// AcceptBloodFIFO dispenses a quantity of a blood type to a patient by drawing on the units that expire
+// soonest, across as many units as needed. Only units cross-matched as compatible with the patient are
+// drawn on. Nothing is dispensed when they cannot cover the full quantity, the error reports the shortfall.
+func (s *BloodDonationChaincode) AcceptBloodFIFO(ctx contractapi.TransactionContextInterface, acceptorID string, patientID string, bloodType string, quantity int, emergencyOverride bool) ([]*AcceptResult, error) {
+    if quantity <= 0 {
+        return nil, fmt.Errorf("Quantity must be greater than zero, got %d", quantity)
+    }
+    bloodType, err := normalizeBloodType(bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    // Usage history must only ever reference registered hospitals
+    _, err = getAcceptor(ctx, acceptorID)
+    if err != nil {
+        return nil, err
+    }
+
+    candidates, err := s.GetAvailableUnitsSortedByExpiry(ctx, bloodType)
+    if err != nil {
+        return nil, err
+    }
+
+    // Pick units in expiry order until the quantity is covered
+    type draw struct {
+        bloodUnit *BloodUnit
+        quantity  int
+    }
+    var draws []draw
+    remaining := quantity
+    for _, bloodUnit := range candidates {
+        if remaining == 0 {
+            break
+        }
+        if bloodUnit.DirectedPatientID != "" && bloodUnit.DirectedPatientID != patientID {
+            continue
+        }
+        compatible, err := hasCompatibleCrossMatch(ctx, bloodUnit.UnitID, patientID)
+        if err != nil {
+            return nil, err
+        }
+        if !compatible {
+            continue
+        }
+        drawn := bloodUnit.Quantity
+        if drawn > remaining {
+            drawn = remaining
+        }
+        draws = append(draws, draw{bloodUnit: bloodUnit, quantity: drawn})
+        remaining -= drawn
+    }
+    if remaining > 0 {
+        return nil, fmt.Errorf("Insufficient %s blood cross-matched for patient %s. Requested: %d, Available: %d, Shortfall: %d",
+            bloodType, patientID, quantity, quantity-remaining, remaining)
+    }
+
+    // Every drawn unit counts fully towards available stock, so the level drops by exactly the quantity
+    reserveFloor, lowStockThreshold, err := getStockLimits(ctx, bloodType)
+    if err != nil {
+        return nil, err
+    }
+    currentLevel := 0
+    if reserveFloor != nil || lowStockThreshold != nil {
+        currentLevel, err = getAvailableQuantity(ctx, bloodType)
+        if err != nil {
+            return nil, err
+        }
+        currentLevel -= quantity
+    }
+
+    // Stock below the reserve floor is held back for emergencies
+    var drawnUnitIDs []string
+    for _, d := range draws {
+        drawnUnitIDs = append(drawnUnitIDs, d.bloodUnit.UnitID)
+    }
+    overrideUsed, err := checkReserveFloor(ctx, reserveFloor, EmergencyOverrideEvent{
+        BloodType:    bloodType,
+        UnitIDs:      drawnUnitIDs,
+        AcceptorID:   acceptorID,
+        PatientID:    patientID,
+        Quantity:     quantity,
+        CurrentLevel: currentLevel,
+    }, emergencyOverride)
+    if err != nil {
+        return nil, err
+    }
+
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return nil, err
+    }
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return nil, err
+    }
+    historyDate := now.Format(dateTimeFormat)
+
+    deltas := make(map[string]*InventorySummary)
+    var results []*AcceptResult
+    var acceptEvents []BloodEvent
+    for _, d := range draws {
+        bloodUnit := d.bloodUnit
+        before := *bloodUnit
+        bloodUnit.Quantity -= d.quantity
+        bloodUnit.DispensedQuantity += d.quantity
+        newStatus := "Partially Used"
+        if bloodUnit.Quantity == 0 {
+            newStatus = "Used"
+        }
+        err = setUnitStatus(bloodUnit, newStatus)
+        if err != nil {
+            return nil, err
+        }
+
+        err = putUsageHistory(ctx, UsageHistory{
+            DocType:    "usageHistory",
+            UnitID:     bloodUnit.UnitID,
+            AcceptorID: acceptorID,
+            PatientID:  patientID,
+            Quantity:   d.quantity,
+            Date:       historyDate,
+            UsedAt:     formatTimestamp(now),
+            RecordedBy: recordedBy,
+            EmergencyOverride: overrideUsed,
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        err = putBloodUnit(ctx, bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        trackInventoryChange(deltas, &before, bloodUnit)
+
+        acceptEvent := BloodEvent{
+            UnitID:     bloodUnit.UnitID,
+            BloodType:  bloodType,
+            Quantity:   d.quantity,
+            AcceptorID: acceptorID,
+        }
+        err = appendEventLog(ctx, "BloodAccepted", acceptEvent)
+        if err != nil {
+            return nil, err
+        }
+        acceptEvents = append(acceptEvents, acceptEvent)
+
+        results = append(results, &AcceptResult{
+            UnitID:            bloodUnit.UnitID,
+            QuantityDispensed: d.quantity,
+            RemainingQuantity: bloodUnit.Quantity,
+            NewStatus:         bloodUnit.Status,
+        })
+    }
+
+    err = updateInventoryCache(ctx, deltas)
+    if err != nil {
+        return nil, err
+    }
+
+    // Fabric keeps a single event per transaction, so all drawn units go into one event, and a low
+    // stock level sends LowStock carrying them instead of BloodAccepted
+    if lowStockThreshold == nil || currentLevel >= lowStockThreshold.Threshold {
+        err = emitEvent(ctx, "BloodAccepted", acceptEvents)
+        if err != nil {
+            return nil, err
+        }
+        return results, nil
+    }
+    err = emitEvent(ctx, "LowStock", LowStockEvent{
+        BloodType:    bloodType,
+        CurrentLevel: currentLevel,
+        Threshold:    lowStockThreshold.Threshold,
+        UnitID:       draws[len(draws)-1].bloodUnit.UnitID,
+        AcceptorID:   acceptorID,
+        Quantity:     quantity,
+        Accepted:     acceptEvents,
+    })
+    if err != nil {
+        return nil, err
+    }
+    return results, nil
+}
+
+// SeparateComponents splits an untested whole blood unit into RBC, plasma and platelet units
+// linked to the parent, and marks the parent as "Separated"
+func (s *BloodDonationChaincode) SeparateComponents(ctx contractapi.TransactionContextInterface, unitID string) ([]*BloodUnit, error) {
+    parentUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return nil, err
+    }
+
+    if parentUnit.ComponentType != "" && parentUnit.ComponentType != "Whole Blood" {
+        return nil, fmt.Errorf("Blood unit %s is a %s component and cannot be separated", unitID, parentUnit.ComponentType)
+    }
+    if parentUnit.Status != "Quarantined" && parentUnit.Status != "Collected" {
+        return nil, fmt.Errorf("Blood unit %s cannot be separated in status %s", unitID, parentUnit.Status)
+    }
+
+    // Each component's expiry runs from the parent's collection date
+    collectedAt, err := time.Parse(dateTimeFormat, parentUnit.Date)
+    if err != nil {
+        return nil, fmt.Errorf("Blood unit %s has an invalid collection date %s", unitID, parentUnit.Date)
+    }
+
+    var components []*BloodUnit
+    for _, split := range componentSplits {
+        shelfLifeDays, err := GetShelfLife(split.ComponentType)
+        if err != nil {
+            return nil, err
+        }
+        componentID := fmt.Sprintf("%s-%s", unitID, strings.ToUpper(split.ComponentType))
+        existingBytes, err := getState(ctx, componentID)
+        if err != nil {
+            return nil, err
+        }
+        if existingBytes != nil {
+            return nil, fmt.Errorf("Blood unit with ID %s already exists", componentID)
+        }
+
+        component := BloodUnit{
+            DocType:       "bloodUnit",
+            UnitID:        componentID,
+            DonorID:       parentUnit.DonorID,
+            AcceptorID:    parentUnit.AcceptorID,
+            BloodType:     parentUnit.BloodType,
+            Quantity:      parentUnit.Quantity * split.Percentage / 100,
+            OriginalQuantity: parentUnit.Quantity * split.Percentage / 100,
+            Status:        "Quarantined",
+            HospitalName:  parentUnit.HospitalName,
+            Date:          parentUnit.Date,
+            ExpiryDate:    collectedAt.AddDate(0, 0, shelfLifeDays).Format(dateTimeFormat),
+            CollectedAt:   formatTimestamp(collectedAt),
+            ExpiresAt:     formatTimestamp(collectedAt.AddDate(0, 0, shelfLifeDays)),
+            ComponentType: split.ComponentType,
+            ParentUnitID:  unitID,
+            RecordedBy:    parentUnit.RecordedBy,
+            TemperatureExcursion: parentUnit.TemperatureExcursion, // Components share the parent's storage history
+            DirectedPatientID: parentUnit.DirectedPatientID,
+        }
+        err = putBloodUnit(ctx, &component)
+        if err != nil {
+            return nil, err
+        }
+        components = append(components, &component)
+    }
+
+    err = setUnitStatus(parentUnit, "Separated")
+    if err != nil {
+        return nil, err
+    }
+    err = putBloodUnit(ctx, parentUnit)
+    if err != nil {
+        return nil, err
+    }
+
+    return components, nil
+}
+
+// ReserveBlood holds a quantity of a blood unit for an acceptor without consuming it. While reserved, the
+// reserving acceptor may draw on the whole unit and other acceptors only on the unreserved rest. The
+// reservation is released once the reserving acceptor has drawn the reserved quantity.
+func (s *BloodDonationChaincode) ReserveBlood(ctx contractapi.TransactionContextInterface, unitID string, acceptorID string, quantity int) error {
+    if quantity <= 0 {
+        return fmt.Errorf("Quantity must be greater than zero, got %d", quantity)
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    if bloodUnit.Status == "Reserved" {
+        return fmt.Errorf("Blood unit %s is already reserved by %s", unitID, bloodUnit.ReservedBy)
+    }
+    if !isAvailableStatus(bloodUnit.Status) || bloodUnit.TestResult != "Safe" {
+        return fmt.Errorf("Blood unit %s is not available for reservation (status %s)", unitID, bloodUnit.Status)
+    }
+    if bloodUnit.Quantity < quantity {
+        return fmt.Errorf("Insufficient blood quantity available. Available: %d, Requested: %d", bloodUnit.Quantity, quantity)
+    }
+
+    before := *bloodUnit
+    err = setUnitStatus(bloodUnit, "Reserved")
+    if err != nil {
+        return err
+    }
+    bloodUnit.ReservedBy = acceptorID
+    bloodUnit.ReservedQuantity = quantity
+
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    deltas := make(map[string]*InventorySummary)
+    trackInventoryChange(deltas, &before, bloodUnit)
+    return updateInventoryCache(ctx, deltas)
+}
+
+// ReleaseReservation cancels the reservation on a blood unit and makes it available again
+func (s *BloodDonationChaincode) ReleaseReservation(ctx contractapi.TransactionContextInterface, unitID string) error {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    if bloodUnit.Status != "Reserved" {
+        return fmt.Errorf("Blood unit %s is not reserved", unitID)
+    }
+
+    before := *bloodUnit
+    err = setUnitStatus(bloodUnit, "Available")
+    if err != nil {
+        return err
+    }
+    bloodUnit.ReservedBy = ""
+    bloodUnit.ReservedQuantity = 0
+
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    deltas := make(map[string]*InventorySummary)
+    trackInventoryChange(deltas, &before, bloodUnit)
+    return updateInventoryCache(ctx, deltas)
+}
+
+// TransferBlood moves some or all of a blood unit from one hospital to another. A full transfer
+// re-assigns the unit, a partial transfer splits the quantity off into a new unit for the receiver.
+func (s *BloodDonationChaincode) TransferBlood(ctx contractapi.TransactionContextInterface, unitID string, fromAcceptorID string, toAcceptorID string, quantity int) error {
+    if quantity <= 0 {
+        return fmt.Errorf("Quantity must be greater than zero, got %d", quantity)
+    }
+    if fromAcceptorID == toAcceptorID {
+        return fmt.Errorf("Cannot transfer blood unit %s from %s to itself", unitID, fromAcceptorID)
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    if bloodUnit.AcceptorID != fromAcceptorID {
+        return fmt.Errorf("Blood unit %s is not held by %s", unitID, fromAcceptorID)
+    }
+    if !isAvailableStatus(bloodUnit.Status) || bloodUnit.TestResult != "Safe" {
+        return fmt.Errorf("Blood unit %s cannot be transferred in status %s", unitID, bloodUnit.Status)
+    }
+    if bloodUnit.Quantity < quantity {
+        return fmt.Errorf("Insufficient blood quantity available. Available: %d, Requested: %d", bloodUnit.Quantity, quantity)
+    }
+
+    // The receiving hospital must be registered so the unit can carry its name
+    toAcceptor, err := getAcceptor(ctx, toAcceptorID)
+    if err != nil {
+        return err
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+
+    before := *bloodUnit
+    deltas := make(map[string]*InventorySummary)
+    transferredUnit := *bloodUnit
+    if bloodUnit.Quantity == quantity {
+        // Full transfer, the unit itself changes hands
+        transferredUnit.AcceptorID = toAcceptorID
+        transferredUnit.HospitalName = toAcceptor.Name
+    } else {
+        // Partial transfer, split the transferred quantity into a new unit
+        bloodUnit.Quantity -= quantity
+        err = putBloodUnit(ctx, bloodUnit)
+        if err != nil {
+            return err
+        }
+        trackInventoryChange(deltas, &before, bloodUnit)
+
+        transferredUnit.UnitID = fmt.Sprintf("%s-%s", unitID, ctx.GetStub().GetTxID())
+        transferredUnit.Version = 0 // A new record, not a revision of the parent
+        transferredUnit.ParentUnitID = unitID
+        transferredUnit.AcceptorID = toAcceptorID
+        transferredUnit.HospitalName = toAcceptor.Name
+        transferredUnit.Quantity = quantity
+        transferredUnit.OriginalQuantity = quantity
+        // Nothing has been dispensed from the new unit, what the parent dispensed stays on the parent
+        transferredUnit.DispensedQuantity = 0
+        transferredUnit.Status = "Available"
+    }
+
+    err = putBloodUnit(ctx, &transferredUnit)
+    if err != nil {
+        return err
+    }
+    if transferredUnit.UnitID == unitID {
+        trackInventoryChange(deltas, &before, &transferredUnit)
+    } else {
+        trackInventoryChange(deltas, nil, &transferredUnit)
+    }
+    err = updateInventoryCache(ctx, deltas)
+    if err != nil {
+        return err
+    }
+
+    // Record the transfer alongside the usage history of the unit
+    transferRecord := TransferRecord{
+        DocType:           "transferRecord",
+        UnitID:            unitID,
+        TransferredUnitID: transferredUnit.UnitID,
+        FromAcceptorID:    fromAcceptorID,
+        ToAcceptorID:      toAcceptorID,
+        Quantity:          quantity,
+        Date:              now.Format(dateTimeFormat),
+        RecordedBy:        recordedBy,
+    }
+    transferBytes, err := json.Marshal(transferRecord)
+    if err != nil {
+        return err
+    }
+    transferKey, err := ctx.GetStub().CreateCompositeKey("transferRecord", []string{unitID, ctx.GetStub().GetTxID()})
+    if err != nil {
+        return err
+    }
+    return putState(ctx, transferKey, transferBytes)
+}
+
+// AddUnitRemark appends a timestamped free-text note to a blood unit, keeping all earlier notes
+func (s *BloodDonationChaincode) AddUnitRemark(ctx contractapi.TransactionContextInterface, unitID string, remark string) error {
+    remark = strings.TrimSpace(remark)
+    if remark == "" {
+        return fmt.Errorf("A remark must not be empty")
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    recordedBy, err := getClientIdentity(ctx)
+    if err != nil {
+        return err
+    }
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+
+    bloodUnit.Remarks = append(bloodUnit.Remarks, fmt.Sprintf("%s %s: %s", now.Format(dateTimeFormat), recordedBy, remark))
+
+    return putBloodUnit(ctx, bloodUnit)
+}
+
+// DisposeUnit records the disposal of an unsafe, rejected, recalled or expired blood unit for regulatory compliance
+func (s *BloodDonationChaincode) DisposeUnit(ctx contractapi.TransactionContextInterface, unitID string, reason string) error {
+    if strings.TrimSpace(reason) == "" {
+        return fmt.Errorf("A disposal reason is required")
+    }
+
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    now, err := getTxTime(ctx)
+    if err != nil {
+        return err
+    }
+
+    // Only unsafe, rejected or recalled units, or expired units that have not been used up, may be disposed of
+    if bloodUnit.Status == "Disposed" {
+        return fmt.Errorf("Blood unit %s has already been disposed of", unitID)
+    }
+    expired := bloodUnit.ExpiryDate != "" && bloodUnit.ExpiryDate < now.Format(dateTimeFormat) && bloodUnit.Status != "Used"
+    if bloodUnit.Status != "Unsafe" && bloodUnit.Status != "Rejected" && bloodUnit.Status != "Recalled" && !expired {
+        return fmt.Errorf("Blood unit %s is neither unsafe, rejected, recalled nor expired and cannot be disposed of (status %s)", unitID, bloodUnit.Status)
+    }
+
+    before := *bloodUnit
+    err = setUnitStatus(bloodUnit, "Disposed")
+    if err != nil {
+        return err
+    }
+    bloodUnit.DisposalReason = reason
+    bloodUnit.DisposalDate = now.Format(dateTimeFormat)
+
+    err = putBloodUnit(ctx, bloodUnit)
+    if err != nil {
+        return err
+    }
+
+    deltas := make(map[string]*InventorySummary)
+    trackInventoryChange(deltas, &before, bloodUnit)
+    err = updateInventoryCache(ctx, deltas)
+    if err != nil {
+        return err
+    }
+
+    disposalEvent := UnitStatusEvent{
+        UnitID:    unitID,
+        BloodType: bloodUnit.BloodType,
+        Status:    bloodUnit.Status,
+        Reason:    reason,
+    }
+    err = appendEventLog(ctx, "UnitDisposed", disposalEvent)
+    if err != nil {
+        return err
+    }
+    return emitEvent(ctx, "UnitDisposed", disposalEvent)
+}
+
+// RecallDonorUnits recalls every unit collected from a donor that has not been used up yet, and lists
+// the units that were already transfused so the recipients can be followed up
+func (s *BloodDonationChaincode) RecallDonorUnits(ctx contractapi.TransactionContextInterface, donorID string, reason string) (*RecallResult, error) {
+    if strings.TrimSpace(reason) == "" {
+        return nil, fmt.Errorf("A recall reason is required")
+    }
+
+    bloodUnits, err := s.QueryDonationHistory(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+
+    result := RecallResult{RecalledUnitIDs: []string{}, UsedUnitIDs: []string{}}
+    deltas := make(map[string]*InventorySummary)
+    var recallEvents []UnitStatusEvent
+    for _, bloodUnit := range bloodUnits {
+        if bloodUnit.Status == "Used" || bloodUnit.Status == "Partially Used" {
+            result.UsedUnitIDs = append(result.UsedUnitIDs, bloodUnit.UnitID)
+        }
+        // Units that are used up or already out of circulation need no recall
+        if bloodUnit.Status == "Used" || bloodUnit.Status == "Disposed" || bloodUnit.Status == "Recalled" || bloodUnit.Status == "Rejected" {
+            continue
+        }
+
+        before := *bloodUnit
+        err = setUnitStatus(bloodUnit, "Recalled")
+        if err != nil {
+            return nil, err
+        }
+        bloodUnit.RecallReason = reason
+        err = putBloodUnit(ctx, bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+        trackInventoryChange(deltas, &before, bloodUnit)
+
+        recallEvent := UnitStatusEvent{
+            UnitID:    bloodUnit.UnitID,
+            BloodType: bloodUnit.BloodType,
+            Status:    bloodUnit.Status,
+            Reason:    reason,
+        }
+        err = appendEventLog(ctx, "UnitRecalled", recallEvent)
+        if err != nil {
+            return nil, err
+        }
+
+        result.RecalledUnitIDs = append(result.RecalledUnitIDs, bloodUnit.UnitID)
+        recallEvents = append(recallEvents, recallEvent)
+    }
+
+    err = updateInventoryCache(ctx, deltas)
+    if err != nil {
+        return nil, err
+    }
+
+    // Fabric keeps a single event per transaction, so all recalled units go into one event
+    if len(recallEvents) > 0 {
+        err = emitEvent(ctx, "UnitRecalled", recallEvents)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return &result, nil
+}
+
+// UseBlood function to mark a blood unit as used
+func (s *BloodDonationChaincode) UseBlood(ctx contractapi.TransactionContextInterface, unitID string) error {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return err
+    }
+
+    // Mark blood unit as used
+    before := *bloodUnit
+    err = setUnitStatus(bloodUnit, "Used")
     if err != nil {
         return err
     }
-    if bloodBytes == nil {
-        return fmt.Errorf("Blood unit with ID %s does not exist", unitID)
-    }
 
-    var bloodUnit BloodUnit
-    err = json.Unmarshal(bloodBytes, &bloodUnit)
+    err = putBloodUnit(ctx, bloodUnit)
     if err != nil {
         return err
     }
 
-    // Update test result and status based on the test result
-    bloodUnit.TestResult = testResult
-    if testResult == "Safe" {
-        bloodUnit.Status = "Tested"
-    } else {
-        bloodUnit.Status = "Unsafe"
+    deltas := make(map[string]*InventorySummary)
+    trackInventoryChange(deltas, &before, bloodUnit)
+    return updateInventoryCache(ctx, deltas)
+}
+
+// GetUnitsNeedingRetest returns a flagged donor's units collected within the last lookbackDays that are
+// still in circulation, oldest first, so the lab can re-screen them. It is the softer alternative to
+// RecallDonorUnits and changes nothing on the ledger.
+func (s *BloodDonationChaincode) GetUnitsNeedingRetest(ctx contractapi.TransactionContextInterface, donorID string, lookbackDays int) ([]*BloodUnit, error) {
+    if lookbackDays <= 0 {
+        return nil, fmt.Errorf("Lookback days must be positive, got %d", lookbackDays)
+    }
+    _, err := getDonor(ctx, donorID)
+    if err != nil {
+        return nil, err
     }
 
-    updatedBloodBytes, err := json.Marshal(bloodUnit)
+    now, err := getTxTime(ctx)
     if err != nil {
-        return err
+        return nil, err
     }
-    return ctx.GetStub().PutState(unitID, updatedBloodBytes)
-}
 
-// Query the details of a donor
-func (s *BloodDonationChaincode) QueryDonor(ctx contractapi.TransactionContextInterface, donorID string) (*Donor, error) {
-    donorBytes, err := ctx.GetStub().GetState(donorID)
+    // Units used up, out of circulation or already found unsafe gain nothing from a retest
+    selector, err := donorUnitsSelector(ctx, donorID)
     if err != nil {
         return nil, err
     }
-    if donorBytes == nil {
-        return nil, fmt.Errorf("Donor with ID %s does not exist", donorID)
+    selector["collectedAt"] = map[string]interface{}{"$gte": formatTimestamp(now.AddDate(0, 0, -lookbackDays))}
+    selector["status"] = map[string]interface{}{"$nin": []string{"Used", "Unsafe", "Separated", "Disposed", "Recalled", "Rejected", "Expired"}}
+    queryString, err := buildSelectorQuery(selector)
+    if err != nil {
+        return nil, err
     }
 
-    var donor Donor
-    err = json.Unmarshal(donorBytes, &donor)
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
     if err != nil {
         return nil, err
     }
-    return &donor, nil
+    bloodUnits, err := collectResults[BloodUnit](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    sort.Slice(bloodUnits, func(i, j int) bool {
+        return bloodUnits[i].Date < bloodUnits[j].Date
+    })
+    return bloodUnits, nil
 }
 
-// Query the details of an acceptor
-func (s *BloodDonationChaincode) QueryAcceptor(ctx contractapi.TransactionContextInterface, acceptorID string) (*Acceptor, error) {
-    acceptorBytes, err := ctx.GetStub().GetState(acceptorID)
+// Query the donation history for a specific donor
+func (s *BloodDonationChaincode) QueryDonationHistory(ctx contractapi.TransactionContextInterface, donorID string) ([]*BloodUnit, error) {
+    selector, err := donorUnitsSelector(ctx, donorID)
     if err != nil {
         return nil, err
     }
-    if acceptorBytes == nil {
-        return nil, fmt.Errorf("Acceptor with ID %s does not exist", acceptorID)
+    queryString, err := buildSelectorQuery(selector)
+    if err != nil {
+        return nil, err
     }
 
-    var acceptor Acceptor
-    err = json.Unmarshal(acceptorBytes, &acceptor)
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
     if err != nil {
         return nil, err
     }
-    return &acceptor, nil
+    return collectResults[BloodUnit](resultsIterator)
 }
 
-// Query the details of a blood unit
-func (s *BloodDonationChaincode) QueryBloodUnit(ctx contractapi.TransactionContextInterface, unitID string) (*BloodUnit, error) {
-    bloodBytes, err := ctx.GetStub().GetState(unitID)
+// QueryDonorTimeline merges a donor's donations with their eligibility changes into one chronological list
+func (s *BloodDonationChaincode) QueryDonorTimeline(ctx contractapi.TransactionContextInterface, donorID string) ([]*TimelineEvent, error) {
+    donations, err := s.QueryDonationHistory(ctx, donorID)
     if err != nil {
         return nil, err
     }
-    if bloodBytes == nil {
-        return nil, fmt.Errorf("Blood unit with ID %s does not exist", unitID)
+
+    timeline := []*TimelineEvent{}
+    for _, bloodUnit := range donations {
+        timeline = append(timeline, &TimelineEvent{
+            EventType: "Donation",
+            Timestamp: bloodUnit.Date,
+            UnitID:    bloodUnit.UnitID,
+            Quantity:  bloodUnit.Quantity,
+        })
     }
 
-    var bloodUnit BloodUnit
-    err = json.Unmarshal(bloodBytes, &bloodUnit)
+    // Eligibility changes come from the records SetDonorEligibility keeps for every deferral and reinstatement
+    changes, err := s.QueryEligibilityHistory(ctx, donorID)
     if err != nil {
         return nil, err
     }
-    return &bloodUnit, nil
+    for _, change := range changes {
+        event := TimelineEvent{EventType: "Reinstated", Timestamp: change.Date}
+        if !change.Eligible {
+            event.EventType = "Deferred"
+            event.Reason = change.Reason
+        }
+        timeline = append(timeline, &event)
+    }
+
+    sort.SliceStable(timeline, func(i, j int) bool {
+        return timeline[i].Timestamp < timeline[j].Timestamp
+    })
+
+    return timeline, nil
 }
 
-// Query blood units by blood type
-func (s *BloodDonationChaincode) QueryBloodUnitsByType(ctx contractapi.TransactionContextInterface, bloodType string) ([]*BloodUnit, error) {
-    queryString := fmt.Sprintf(`{"selector":{"bloodType":"%s"}}`, bloodType)
+// CountDonationsByDonor returns the number of donations and total quantity donated by a donor
+// without returning the full donation history
+func (s *BloodDonationChaincode) CountDonationsByDonor(ctx contractapi.TransactionContextInterface, donorID string) (*DonationCount, error) {
+    selector, err := donorUnitsSelector(ctx, donorID)
+    if err != nil {
+        return nil, err
+    }
+    queryString, err := buildSelectorQuery(selector)
+    if err != nil {
+        return nil, err
+    }
 
     resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
     if err != nil {
@@ -178,7 +5359,7 @@ func (s *BloodDonationChaincode) QueryBloodUnitsByType(ctx contractapi.Transacti
     }
     defer resultsIterator.Close()
 
-    var bloodUnits []*BloodUnit
+    donationCount := DonationCount{DonorID: donorID}
     for resultsIterator.HasNext() {
         queryResponse, err := resultsIterator.Next()
         if err != nil {
@@ -190,115 +5371,485 @@ func (s *BloodDonationChaincode) QueryBloodUnitsByType(ctx contractapi.Transacti
         if err != nil {
             return nil, err
         }
-        bloodUnits = append(bloodUnits, &bloodUnit)
+
+        // Units split off a donation (components, partial transfers) are not donations themselves
+        if bloodUnit.ParentUnitID != "" {
+            continue
+        }
+
+        // Units recorded before OriginalQuantity existed only have their current quantity
+        quantity := bloodUnit.OriginalQuantity
+        if quantity == 0 {
+            quantity = bloodUnit.Quantity
+        }
+        donationCount.DonationCount++
+        donationCount.TotalQuantity += quantity
     }
 
-    return bloodUnits, nil
+    return &donationCount, nil
 }
 
-// AcceptBlood function to update the status of a blood unit when accepted by a hospital
-func (s *BloodDonationChaincode) AcceptBlood(ctx contractapi.TransactionContextInterface, unitID string, acceptorID string, quantity int) error {
-    bloodBytes, err := ctx.GetStub().GetState(unitID)
+// GetDonationTrend counts the donations collected between two dates per day, week or month, oldest
+// period first. Periods without donations are included so charts have no gaps. Weeks start on Monday.
+func (s *BloodDonationChaincode) GetDonationTrend(ctx contractapi.TransactionContextInterface, startDate string, endDate string, bucket string) ([]*DonationTrendBucket, error) {
+    // periodStart truncates a time to the start of its period, periodLabel names the period
+    var periodStart func(t time.Time) time.Time
+    var periodLabel func(t time.Time) string
+    var nextPeriod func(t time.Time) time.Time
+    switch bucket {
+    case "day":
+        periodStart = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC) }
+        periodLabel = func(t time.Time) string { return t.Format(dateFormat) }
+        nextPeriod = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+    case "week":
+        periodStart = func(t time.Time) time.Time {
+            day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+            return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+        }
+        periodLabel = func(t time.Time) string { return t.Format(dateFormat) }
+        nextPeriod = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+    case "month":
+        periodStart = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) }
+        periodLabel = func(t time.Time) string { return t.Format("2006-01") }
+        nextPeriod = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+    default:
+        return nil, fmt.Errorf("Invalid bucket %s, must be day, week or month", bucket)
+    }
+
+    start, err := parseDateBound(startDate, false)
     if err != nil {
-        return err
+        return nil, err
     }
-    if bloodBytes == nil {
-        return fmt.Errorf("Blood unit with ID %s does not exist", unitID)
+    end, err := parseDateBound(endDate, true)
+    if err != nil {
+        return nil, err
+    }
+    if start.After(end) {
+        return nil, fmt.Errorf("Start date %s must not be after end date %s", startDate, endDate)
     }
 
-    var bloodUnit BloodUnit
-    err = json.Unmarshal(bloodBytes, &bloodUnit)
-    if err != nil {
-        return err
+    // Lay out every period of the range up front so empty ones are reported too
+    var trend []*DonationTrendBucket
+    bucketsByPeriod := make(map[string]*DonationTrendBucket)
+    for period := periodStart(start); !period.After(end); period = nextPeriod(period) {
+        trendBucket := &DonationTrendBucket{Period: periodLabel(period)}
+        trend = append(trend, trendBucket)
+        bucketsByPeriod[trendBucket.Period] = trendBucket
     }
 
-    // Check if the quantity requested is available
-    if bloodUnit.Quantity < quantity {
-        return fmt.Errorf("Insufficient blood quantity available. Available: %d, Requested: %d", bloodUnit.Quantity, quantity)
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType": "bloodUnit",
+        "collectedAt": map[string]interface{}{
+            "$gte": formatTimestamp(start),
+            "$lte": formatTimestamp(end),
+        },
+    })
+    if err != nil {
+        return nil, err
+    }
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
+    }
+    bloodUnits, err := collectResults[BloodUnit](resultsIterator)
+    if err != nil {
+        return nil, err
     }
 
-    // Update the quantity of the blood unit
-    bloodUnit.Quantity -= quantity
+    for _, bloodUnit := range bloodUnits {
+        // Units split off a donation (components, partial transfers) are not donations themselves
+        if bloodUnit.ParentUnitID != "" {
+            continue
+        }
+        collected, err := time.Parse(dateTimeFormat, bloodUnit.Date)
+        if err != nil {
+            return nil, err
+        }
+        trendBucket, ok := bucketsByPeriod[periodLabel(periodStart(collected))]
+        if !ok {
+            continue
+        }
 
-    // Log the transaction
-    transactionRecord := fmt.Sprintf("Blood unit %s accepted by %s, quantity: %d", unitID, acceptorID, quantity)
-    fmt.Println(transactionRecord) // Log the acceptance of blood
+        // Units recorded before OriginalQuantity existed only have their current quantity
+        quantity := bloodUnit.OriginalQuantity
+        if quantity == 0 {
+            quantity = bloodUnit.Quantity
+        }
+        trendBucket.DonationCount++
+        trendBucket.TotalQuantity += quantity
+    }
 
-    // Automatically mark the blood unit as used if quantity is zero
-    if bloodUnit.Quantity == 0 {
-        bloodUnit.Status = "Used"
-        return s.UseBlood(ctx, unitID)
-    } else {
-        bloodUnit.Status = "Partially Used" // Indicate that some quantity is still available
+    return trend, nil
+}
+
+// GetTopDonors returns the n donors with the most donations, most recent donor first on a tie
+func (s *BloodDonationChaincode) GetTopDonors(ctx contractapi.TransactionContextInterface, n int) ([]*DonorRanking, error) {
+    if n <= 0 {
+        return nil, fmt.Errorf("Number of donors must be positive, got %d", n)
     }
 
-    updatedBloodBytes, err := json.Marshal(bloodUnit)
+    resultsIterator, err := ctx.GetStub().GetQueryResult(`{"selector":{"docType":"bloodUnit"}}`)
     if err != nil {
-        return err
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    rankingsByDonor := make(map[string]*DonorRanking)
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var bloodUnit BloodUnit
+        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        if err != nil {
+            return nil, err
+        }
+
+        // Units split off a donation (components, partial transfers) are not donations themselves, and
+        // units referencing their donor by hash cannot be attributed without the private collection
+        if bloodUnit.ParentUnitID != "" || bloodUnit.DonorID == "" {
+            continue
+        }
+
+        ranking, ok := rankingsByDonor[bloodUnit.DonorID]
+        if !ok {
+            ranking = &DonorRanking{DonorID: bloodUnit.DonorID}
+            rankingsByDonor[bloodUnit.DonorID] = ranking
+        }
+        ranking.DonationCount++
+        if bloodUnit.Date > ranking.LastDonationDate {
+            ranking.LastDonationDate = bloodUnit.Date
+        }
+    }
+
+    rankings := []*DonorRanking{}
+    for _, ranking := range rankingsByDonor {
+        rankings = append(rankings, ranking)
+    }
+    // Map iteration order is random, so fall back to the donor ID to keep every peer's result identical
+    sort.Slice(rankings, func(i, j int) bool {
+        if rankings[i].DonationCount != rankings[j].DonationCount {
+            return rankings[i].DonationCount > rankings[j].DonationCount
+        }
+        if rankings[i].LastDonationDate != rankings[j].LastDonationDate {
+            return rankings[i].LastDonationDate > rankings[j].LastDonationDate
+        }
+        return rankings[i].DonorID < rankings[j].DonorID
+    })
+    if len(rankings) > n {
+        rankings = rankings[:n]
+    }
+
+    // Only the donors that made the cut are looked up for their names
+    for _, ranking := range rankings {
+        donor, err := getDonor(ctx, ranking.DonorID)
+        if errors.Is(err, ErrDonorNotFound) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        ranking.Name = donor.Name
     }
-    return ctx.GetStub().PutState(unitID, updatedBloodBytes)
+
+    return rankings, nil
 }
 
-// Update the status of a blood unit to "Used"
-func (s *BloodDonationChaincode) UseBlood(ctx contractapi.TransactionContextInterface, unitID string) error {
-    bloodBytes, err := ctx.GetStub().GetState(unitID)
+// Query all blood units associated with a specific donor ID, kept for clients of the earlier
+// contract and equivalent to QueryDonationHistory
+func (s *BloodDonationChaincode) QueryBloodUnitsByDonorID(ctx contractapi.TransactionContextInterface, donorID string) ([]*BloodUnit, error) {
+    return s.QueryDonationHistory(ctx, donorID)
+}
+
+// QueryUsageHistory queries the usage history for a specific acceptor
+func (s *BloodDonationChaincode) QueryUsageHistory(ctx contractapi.TransactionContextInterface, acceptorID string) ([]*UsageHistory, error) {
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "usageHistory",
+        "acceptorID": acceptorID,
+    })
     if err != nil {
-        return err
+        return nil, err
     }
-    if bloodBytes == nil {
-        return fmt.Errorf("Blood unit with ID %s does not exist", unitID)
+
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return nil, err
     }
+    return collectResults[UsageHistory](resultsIterator)
+}
 
-    var bloodUnit BloodUnit
-    err = json.Unmarshal(bloodBytes, &bloodUnit)
+// QueryUsageHistoryByDateRange returns the usage history of an acceptor whose date falls within the inclusive range
+func (s *BloodDonationChaincode) QueryUsageHistoryByDateRange(ctx contractapi.TransactionContextInterface, acceptorID string, startDate string, endDate string) ([]*UsageHistory, error) {
+    start, err := parseDateBound(startDate, false)
     if err != nil {
-        return err
+        return nil, err
+    }
+    end, err := parseDateBound(endDate, true)
+    if err != nil {
+        return nil, err
+    }
+    if start.After(end) {
+        return nil, fmt.Errorf("Start date %s must not be after end date %s", startDate, endDate)
     }
 
-    bloodUnit.Status = "Used" // Update status to used
+    queryString, err := buildSelectorQuery(map[string]interface{}{
+        "docType":    "usageHistory",
+        "acceptorID": acceptorID,
+        "usedAt": map[string]interface{}{
+            "$gte": formatTimestamp(start),
+            "$lte": formatTimestamp(end),
+        },
+    })
+    if err != nil {
+        return nil, err
+    }
 
-    updatedBloodBytes, err := json.Marshal(bloodUnit)
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
     if err != nil {
-        return err
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var usageHistoryList []*UsageHistory
+    for resultsIterator.HasNext() {
+        queryResponse, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var usageHistory UsageHistory
+        err = json.Unmarshal(queryResponse.Value, &usageHistory)
+        if err != nil {
+            return nil, err
+        }
+        usageHistoryList = append(usageHistoryList, &usageHistory)
     }
-    return ctx.GetStub().PutState(unitID, updatedBloodBytes)
+
+    return usageHistoryList, nil
 }
 
-// Query the donation history for a specific donor
-func (s *BloodDonationChaincode) QueryDonationHistory(ctx contractapi.TransactionContextInterface, donorID string) ([]*BloodUnit, error) {
-    queryString := fmt.Sprintf(`{"selector":{"donorID":"%s"}}`, donorID)
+// QueryEventLog returns the audit log entries recorded between two dates, oldest first. An empty
+// eventType returns entries of every type.
+func (s *BloodDonationChaincode) QueryEventLog(ctx contractapi.TransactionContextInterface, startDate string, endDate string, eventType string) ([]*EventLogEntry, error) {
+    start, err := parseDateBound(startDate, false)
+    if err != nil {
+        return nil, err
+    }
+    end, err := parseDateBound(endDate, true)
+    if err != nil {
+        return nil, err
+    }
+    if start.After(end) {
+        return nil, fmt.Errorf("Start date %s must not be after end date %s", startDate, endDate)
+    }
+
+    selector := map[string]interface{}{
+        "docType": "eventLog",
+        "date": map[string]interface{}{
+            "$gte": start.Format(dateTimeFormat),
+            "$lte": end.Format(dateTimeFormat),
+        },
+    }
+    if eventType != "" {
+        selector["eventType"] = eventType
+    }
+    queryString, err := buildSelectorQuery(selector)
+    if err != nil {
+        return nil, err
+    }
 
     resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
     if err != nil {
         return nil, err
     }
+    entries, err := collectResults[EventLogEntry](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    // Stored dates sort lexically in chronological order
+    sort.SliceStable(entries, func(i, j int) bool {
+        return entries[i].Date < entries[j].Date
+    })
+    return entries, nil
+}
+
+// QueryHistoryByUnit returns all usage history entries recorded for a specific blood unit
+func (s *BloodDonationChaincode) QueryHistoryByUnit(ctx contractapi.TransactionContextInterface, unitID string) ([]*UsageHistory, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("usageHistory", []string{unitID})
+    if err != nil {
+        return nil, err
+    }
     defer resultsIterator.Close()
 
-    var donationHistory []*BloodUnit
+    var usageHistoryList []*UsageHistory
     for resultsIterator.HasNext() {
         queryResponse, err := resultsIterator.Next()
         if err != nil {
             return nil, err
         }
 
-        var bloodUnit BloodUnit
-        err = json.Unmarshal(queryResponse.Value, &bloodUnit)
+        var usageHistory UsageHistory
+        err = json.Unmarshal(queryResponse.Value, &usageHistory)
+        if err != nil {
+            return nil, err
+        }
+        usageHistoryList = append(usageHistoryList, &usageHistory)
+    }
+
+    return usageHistoryList, nil
+}
+
+// QueryUsageHistoryForUnit returns every usage and transfer event of a blood unit, whichever acceptor
+// was involved, in chronological order
+func (s *BloodDonationChaincode) QueryUsageHistoryForUnit(ctx contractapi.TransactionContextInterface, unitID string) ([]*UnitActivity, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("usageHistory", []string{unitID})
+    if err != nil {
+        return nil, err
+    }
+    usageHistoryList, err := collectResults[UsageHistory](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    resultsIterator, err = ctx.GetStub().GetStateByPartialCompositeKey("transferRecord", []string{unitID})
+    if err != nil {
+        return nil, err
+    }
+    transferRecords, err := collectResults[TransferRecord](resultsIterator)
+    if err != nil {
+        return nil, err
+    }
+
+    activities := []*UnitActivity{}
+    for _, usageHistory := range usageHistoryList {
+        activities = append(activities, &UnitActivity{EventType: "Usage", Date: usageHistory.Date, Usage: usageHistory})
+    }
+    for _, transferRecord := range transferRecords {
+        activities = append(activities, &UnitActivity{EventType: "Transfer", Date: transferRecord.Date, Transfer: transferRecord})
+    }
+
+    // Stored dates sort lexically in chronological order
+    sort.SliceStable(activities, func(i, j int) bool {
+        return activities[i].Date < activities[j].Date
+    })
+    return activities, nil
+}
+
+// GetUnitProvenance returns the full chain of custody of a blood unit: the donor, the acceptor now
+// holding it, every transfer and every usage. Missing donor or acceptor records are listed rather
+// than failing the call, so the rest of the chain can still be inspected.
+func (s *BloodDonationChaincode) GetUnitProvenance(ctx contractapi.TransactionContextInterface, unitID string) (*UnitProvenance, error) {
+    bloodUnit, err := getBloodUnit(ctx, unitID)
+    if err != nil {
+        return nil, err
+    }
+
+    provenance := UnitProvenance{
+        BloodUnit:      bloodUnit,
+        Transfers:      []*TransferRecord{},
+        MissingRecords: []string{},
+    }
+
+    donor, err := getDonor(ctx, bloodUnit.DonorID)
+    if errors.Is(err, ErrDonorNotFound) {
+        provenance.MissingRecords = append(provenance.MissingRecords, fmt.Sprintf("Donor %s", bloodUnit.DonorID))
+    } else if err != nil {
+        return nil, err
+    }
+    provenance.Donor = donor
+
+    if bloodUnit.AcceptorID != "" {
+        acceptor, err := getAcceptor(ctx, bloodUnit.AcceptorID)
+        if errors.Is(err, ErrAcceptorNotFound) {
+            provenance.MissingRecords = append(provenance.MissingRecords, fmt.Sprintf("Acceptor %s", bloodUnit.AcceptorID))
+        } else if err != nil {
+            return nil, err
+        }
+        provenance.Acceptor = acceptor
+    }
+
+    // Transfers are keyed by the unit they were taken from, so a unit split off by a partial
+    // transfer finds its own transfer under the parent unit
+    transferSources := []string{unitID}
+    if bloodUnit.ParentUnitID != "" {
+        transferSources = append(transferSources, bloodUnit.ParentUnitID)
+    }
+    for _, sourceUnitID := range transferSources {
+        resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("transferRecord", []string{sourceUnitID})
         if err != nil {
             return nil, err
         }
-        donationHistory = append(donationHistory, &bloodUnit)
+        for resultsIterator.HasNext() {
+            queryResponse, err := resultsIterator.Next()
+            if err != nil {
+                resultsIterator.Close()
+                return nil, err
+            }
+
+            var transferRecord TransferRecord
+            err = json.Unmarshal(queryResponse.Value, &transferRecord)
+            if err != nil {
+                resultsIterator.Close()
+                return nil, err
+            }
+            if transferRecord.UnitID == unitID || transferRecord.TransferredUnitID == unitID {
+                provenance.Transfers = append(provenance.Transfers, &transferRecord)
+            }
+        }
+        resultsIterator.Close()
+    }
+    sort.SliceStable(provenance.Transfers, func(i, j int) bool {
+        return provenance.Transfers[i].Date < provenance.Transfers[j].Date
+    })
+
+    usage, err := s.QueryHistoryByUnit(ctx, unitID)
+    if err != nil {
+        return nil, err
+    }
+    provenance.Usage = usage
+    if provenance.Usage == nil {
+        provenance.Usage = []*UsageHistory{}
     }
 
-    return donationHistory, nil
+    return &provenance, nil
 }
 
+// GetContractInfo reports the version, build and transaction functions of the deployed chaincode,
+// so clients can confirm which logic is active during a rolling upgrade
+func (s *BloodDonationChaincode) GetContractInfo(ctx contractapi.TransactionContextInterface) (*ContractInfo, error) {
+    info := ContractInfo{
+        Version:   ContractVersion,
+        BuildID:   buildID,
+        Functions: []string{},
+    }
+
+    // Transaction functions are the exported methods taking the transaction context, which leaves out
+    // the housekeeping methods of the embedded contractapi.Contract. Methods are listed sorted by name.
+    contextType := reflect.TypeOf((*contractapi.TransactionContextInterface)(nil)).Elem()
+    contractType := reflect.TypeOf(s)
+    for i := 0; i < contractType.NumMethod(); i++ {
+        method := contractType.Method(i)
+        if method.Type.NumIn() > 1 && method.Type.In(1) == contextType {
+            info.Functions = append(info.Functions, method.Name)
+        }
+    }
+
+    return &info, nil
+}
 
-// Main function
+// Main function starts the chaincode
 func main() {
-    chaincode, err := contractapi.NewChaincode(new(BloodDonationChaincode))
+    contract := new(BloodDonationChaincode)
+    contract.TransactionContextHandler = new(stateCachingContext)
+
+    chaincode, err := contractapi.NewChaincode(contract)
     if err != nil {
-        panic(err)
+        panic(fmt.Errorf("Error creating BloodDonation chaincode: %s", err))
     }
+
     if err := chaincode.Start(); err != nil {
         panic(err)
     }
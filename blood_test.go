@@ -0,0 +1,1148 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+// newTestContract returns the contract with an empty fake ledger, called by a lab client
+func newTestContract() (*BloodDonationChaincode, *fakeContext) {
+    return &BloodDonationChaincode{}, newFakeContext()
+}
+
+// expectError fails the test unless err is non-nil and mentions want
+func expectError(t *testing.T, err error, want string) {
+    t.Helper()
+    if err == nil {
+        t.Fatalf("Expected an error mentioning %q, got none", want)
+    }
+    if !strings.Contains(err.Error(), want) {
+        t.Fatalf("Expected an error mentioning %q, got %v", want, err)
+    }
+}
+
+// registerDonor registers a consenting adult donor and commits
+func registerDonor(t *testing.T, s *BloodDonationChaincode, ctx *fakeContext, donorID string, bloodType string) {
+    t.Helper()
+    if err := s.RegisterDonor(ctx, donorID, "Donor "+donorID, bloodType, "", "", "1990-01-01", "Female", "none"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    if err := s.RecordConsent(ctx, donorID, true, "2024-01-01"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+}
+
+// registerAcceptor registers a hospital and commits
+func registerAcceptor(t *testing.T, s *BloodDonationChaincode, ctx *fakeContext, acceptorID string, name string) {
+    t.Helper()
+    if err := s.RegisterAcceptor(ctx, acceptorID, name, "Chennai", "+91 44 2345 6789"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+}
+
+// donate records a 450 mL donation from an already registered donor to an already registered acceptor
+func donate(t *testing.T, s *BloodDonationChaincode, ctx *fakeContext, unitID string, donorID string, bloodType string, acceptorID string) {
+    t.Helper()
+    if err := s.RecordDonation(ctx, unitID, donorID, bloodType, 450, "City Hospital", acceptorID, ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+}
+
+// makeAvailable tests a unit safe, releases it to stock and cross-matches it with patientID
+func makeAvailable(t *testing.T, s *BloodDonationChaincode, ctx *fakeContext, unitID string, patientID string) {
+    t.Helper()
+    if err := s.TestBlood(ctx, unitID, "Safe"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    if err := s.MakeAvailable(ctx, unitID); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    if err := s.RecordCrossMatch(ctx, unitID, patientID, "Compatible"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+}
+
+// setupAvailableUnit registers donor D1 and acceptor A1 and puts an available O- unit U1 in stock
+func setupAvailableUnit(t *testing.T) (*BloodDonationChaincode, *fakeContext) {
+    t.Helper()
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+    makeAvailable(t, s, ctx, "U1", "P1")
+    return s, ctx
+}
+
+func TestRegisterDonor(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "o-")
+
+    donor, err := s.QueryDonor(ctx, "D1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if donor.BloodType != "O-" || donor.Age != 34 || !donor.ConsentStatus {
+        t.Fatalf("Unexpected donor %+v", donor)
+    }
+
+    err = s.RegisterDonor(ctx, "D1", "Again", "O-", "", "", "1990-01-01", "Female", "none")
+    expectError(t, err, "already exists")
+}
+
+func TestRecordDonationAndAccept(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+
+    result, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 200, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.RemainingQuantity != 250 || result.NewStatus != "Partially Used" {
+        t.Fatalf("Unexpected result %+v", result)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    history, err := s.QueryHistoryByUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(history) != 1 || history[0].Quantity != 200 || history[0].PatientID != "P1" {
+        t.Fatalf("Unexpected usage history %+v", history)
+    }
+}
+
+func TestAcceptBloodMissingUnit(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    _, err := s.AcceptBlood(ctx, "NOPE", "A1", "P1", 100, false, "")
+    if !errors.Is(err, ErrUnitNotFound) {
+        t.Fatalf("Expected ErrUnitNotFound, got %v", err)
+    }
+}
+
+func TestUpdateDonor(t *testing.T) {
+    s, ctx := newTestContract()
+    _, err := s.UpdateDonor(ctx, "D1", "Name", "A+", "", "", "1990-01-01", "Female", "none", false)
+    if !errors.Is(err, ErrDonorNotFound) {
+        t.Fatalf("Expected ErrDonorNotFound, got %v", err)
+    }
+
+    registerDonor(t, s, ctx, "D1", "O-")
+    if _, err := s.UpdateDonor(ctx, "D1", "Corrected Name", "A+", "", "", "1990-01-01", "Female", "none", false); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    donor, err := s.QueryDonor(ctx, "D1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if donor.DonorID != "D1" || donor.Name != "Corrected Name" || donor.BloodType != "A+" {
+        t.Fatalf("Update not persisted: %+v", donor)
+    }
+}
+
+func TestQuantityValidation(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+
+    for _, quantity := range []int{0, -50} {
+        err := s.RecordDonation(ctx, "U2", "D1", "O-", quantity, "City Hospital", "A1", "")
+        expectError(t, err, "Donation volume")
+        _, err = s.AcceptBlood(ctx, "U1", "A1", "P1", quantity, false, "")
+        expectError(t, err, "Quantity must be greater than zero")
+    }
+
+    _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 451, false, "")
+    expectError(t, err, "Insufficient blood quantity")
+    unit, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if unit.Quantity != 450 {
+        t.Fatalf("Over-request changed the unit: %+v", unit)
+    }
+}
+
+func TestDonationVolumeBoundaries(t *testing.T) {
+    s, ctx := newTestContract()
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    cases := []struct {
+        quantity int
+        valid    bool
+    }{
+        {MinReasonableDonationVolume - 1, false},
+        {MinReasonableDonationVolume, true},
+        {MaxReasonableDonationVolume, true},
+        {MaxReasonableDonationVolume + 1, false},
+    }
+    for i, c := range cases {
+        // A fresh donor each time keeps the donation interval out of the way
+        donorID := "D" + string(rune('1'+i))
+        registerDonor(t, s, ctx, donorID, "A+")
+        err := s.RecordDonation(ctx, "U"+donorID, donorID, "A+", c.quantity, "City Hospital", "A1", "")
+        if c.valid && err != nil {
+            t.Fatalf("Volume %d rejected: %v", c.quantity, err)
+        }
+        if !c.valid {
+            expectError(t, err, "Donation volume must be between")
+        }
+        ctx.stub().nextTx(t, time.Minute)
+    }
+}
+
+func TestTestBloodCannotBeRepeated(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerDonor(t, s, ctx, "D2", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+    donate(t, s, ctx, "U2", "D2", "O-", "A1")
+
+    if err := s.TestBlood(ctx, "U1", "Unsafe"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.TestBlood(ctx, "U2", "Safe"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    expectError(t, s.TestBlood(ctx, "U1", "Safe"), "already been tested")
+    expectError(t, s.TestBlood(ctx, "U2", "Unsafe"), "already been tested")
+}
+
+func TestTestBloodRequiresLabMSP(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+
+    ctx.identity().mspID = "HospitalMSP"
+    expectError(t, s.TestBlood(ctx, "U1", "Safe"), "Permission denied")
+
+    ctx.identity().mspID = authorizedLabMSPID
+    if err := s.TestBlood(ctx, "U1", "Safe"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestAcceptBloodRejectsUntestedAndUnsafe(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerDonor(t, s, ctx, "D2", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+    donate(t, s, ctx, "U2", "D2", "O-", "A1")
+    if err := s.TestBlood(ctx, "U2", "Unsafe"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 100, false, "")
+    expectError(t, err, "awaiting its lab result")
+    _, err = s.AcceptBlood(ctx, "U2", "A1", "P1", 100, false, "")
+    expectError(t, err, "unsafe")
+}
+
+func TestAcceptBloodUsesUpUnit(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    if _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 450, false, ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    unit, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if unit.Status != "Used" || unit.Quantity != 0 {
+        t.Fatalf("Expected a used unit with quantity 0, got status %s quantity %d", unit.Status, unit.Quantity)
+    }
+}
+
+func TestSeparateComponents(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "B+")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "B+", "A1")
+
+    components, err := s.SeparateComponents(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    types := map[string]bool{}
+    for _, component := range components {
+        if component.ParentUnitID != "U1" || component.DonorID != "D1" {
+            t.Fatalf("Component not linked to its parent: %+v", component)
+        }
+        types[component.ComponentType] = true
+    }
+    if len(components) != 3 || !types["RBC"] || !types["Plasma"] || !types["Platelets"] {
+        t.Fatalf("Unexpected components %+v", components)
+    }
+    parent, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if parent.Status != "Separated" {
+        t.Fatalf("Parent status is %s, expected Separated", parent.Status)
+    }
+}
+
+func TestDeferredDonorCannotDonate(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    if err := s.SetDonorEligibility(ctx, "D1", false, "Low hemoglobin"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    err := s.RecordDonation(ctx, "U1", "D1", "O-", 450, "City Hospital", "A1", "")
+    expectError(t, err, "Low hemoglobin")
+}
+
+func TestQueryAcceptorsByLocation(t *testing.T) {
+    s, ctx := newTestContract()
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+
+    acceptors, err := s.QueryAcceptorsByLocation(ctx, "chennai")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(acceptors) != 1 || acceptors[0].AcceptorID != "A1" {
+        t.Fatalf("Unexpected acceptors %+v", acceptors)
+    }
+    acceptors, err = s.QueryAcceptorsByLocation(ctx, "Mumbai")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(acceptors) != 0 {
+        t.Fatalf("Expected no acceptors, got %+v", acceptors)
+    }
+}
+
+func TestUpdateAcceptor(t *testing.T) {
+    s, ctx := newTestContract()
+    err := s.UpdateAcceptor(ctx, "A1", "City Hospital", "Chennai", "+91 44 2345 6789")
+    if !errors.Is(err, ErrAcceptorNotFound) {
+        t.Fatalf("Expected ErrAcceptorNotFound, got %v", err)
+    }
+}
+
+func TestSelectorInjection(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+
+    // The input is encoded as a plain string value, so it matches nothing instead of widening the query
+    units, err := s.QueryBloodUnitsByType(ctx, `O-"},"docType":{"$ne":"x`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(units) != 0 {
+        t.Fatalf("Injected selector matched %d units", len(units))
+    }
+
+    units, err = s.QueryBloodUnitsByHospital(ctx, `City Hospital"},"$or":[{"docType":"bloodUnit"}],"x":{"y":"`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(units) != 0 {
+        t.Fatalf("Injected selector matched %d units", len(units))
+    }
+}
+
+func TestRejectDonation(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerDonor(t, s, ctx, "D2", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+    donate(t, s, ctx, "U2", "D2", "O-", "A1")
+
+    if err := s.RejectDonation(ctx, "U1", "Travel history"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.TestBlood(ctx, "U2", "Unsafe"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    rejected, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    unsafe, err := s.QueryBloodUnit(ctx, "U2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rejected.Status != "Rejected" || rejected.TestResult != "" || rejected.RejectionReason != "Travel history" {
+        t.Fatalf("Unexpected rejected unit %+v", rejected)
+    }
+    if unsafe.Status != "Unsafe" || unsafe.RejectionReason != "" {
+        t.Fatalf("Unexpected unsafe unit %+v", unsafe)
+    }
+    expectError(t, s.TestBlood(ctx, "U1", "Safe"), "cannot be tested")
+
+    compatible, err := s.QueryCompatibleUnits(ctx, "O-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(compatible) != 0 {
+        t.Fatalf("Rejected or unsafe units listed as available: %+v", compatible)
+    }
+}
+
+func TestQueryBloodUnitsByHospital(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerDonor(t, s, ctx, "D2", "A+")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    registerAcceptor(t, s, ctx, "A2", "Lake Clinic")
+    if err := s.RecordDonation(ctx, "U1", "D1", "O-", 450, "City Hospital", "A1", ""); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.RecordDonation(ctx, "U2", "D2", "A+", 450, "Lake Clinic", "A2", ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    units, err := s.QueryBloodUnitsByHospital(ctx, "Lake Clinic")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(units) != 1 || units[0].UnitID != "U2" {
+        t.Fatalf("Unexpected units for Lake Clinic %+v", units)
+    }
+    units, err = s.QueryBloodUnitsByAcceptor(ctx, "A1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(units) != 1 || units[0].UnitID != "U1" {
+        t.Fatalf("Unexpected units for A1 %+v", units)
+    }
+}
+
+func TestDonorAgeLimits(t *testing.T) {
+    s, ctx := newTestContract()
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    cases := map[string]string{
+        "YOUNG": "2007-03-02", // 17, a day short of 18
+        "OLD":   "1958-01-01", // 66
+    }
+    for donorID, dateOfBirth := range cases {
+        if err := s.RegisterDonor(ctx, donorID, donorID, "O+", "", "", dateOfBirth, "Male", "none"); err != nil {
+            t.Fatal(err)
+        }
+        ctx.stub().nextTx(t, time.Minute)
+        if err := s.RecordConsent(ctx, donorID, true, "2024-01-01"); err != nil {
+            t.Fatal(err)
+        }
+        ctx.stub().nextTx(t, time.Minute)
+
+        err := s.RecordDonation(ctx, "U-"+donorID, donorID, "O+", 450, "City Hospital", "A1", "")
+        expectError(t, err, "donors must be between")
+    }
+
+    expectError(t, s.RegisterDonor(ctx, "BAD", "Bad", "O+", "", "", "01/02/1990", "Male", "none"), "Invalid date of birth")
+}
+
+func TestConcurrentAcceptMVCCConflict(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    registerAcceptor(t, s, ctx, "A2", "Lake Clinic")
+    if err := s.RecordCrossMatch(ctx, "U1", "P2", "Compatible"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    // Both hospitals are endorsed against the same committed version of the unit
+    if _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 300, false, ""); err != nil {
+        t.Fatal(err)
+    }
+    first := ctx.stub().endorse()
+    if _, err := s.AcceptBlood(ctx, "U1", "A2", "P2", 300, false, ""); err != nil {
+        t.Fatal(err)
+    }
+    second := ctx.stub().endorse()
+
+    if err := ctx.stub().commit(first); err != nil {
+        t.Fatal(err)
+    }
+    err := ctx.stub().commit(second)
+    expectError(t, err, "MVCC_READ_CONFLICT")
+
+    // The client re-reads the unit, sees the new version and decides again
+    unit, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if unit.Quantity != 150 || unit.Version != 4 {
+        t.Fatalf("Unexpected unit after the conflict: quantity %d version %d", unit.Quantity, unit.Version)
+    }
+    _, err = s.AcceptBlood(ctx, "U1", "A2", "P2", 300, false, "")
+    expectError(t, err, "Insufficient blood quantity")
+}
+
+func TestStatusTransitions(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+
+    expectError(t, s.MakeAvailable(ctx, "U1"), "Only units tested safe can be made available")
+    expectError(t, s.UseBlood(ctx, "U1"), "cannot move from status Quarantined to Used")
+
+    makeAvailable(t, s, ctx, "U1", "P1")
+    if err := s.UseBlood(ctx, "U1"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    expectError(t, s.TestBlood(ctx, "U1", "Safe"), "cannot be tested")
+    expectError(t, s.UseBlood(ctx, "U1"), "cannot move from status Used to Used")
+    _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 10, false, "")
+    if err == nil {
+        t.Fatal("A used unit was dispensed again")
+    }
+
+    allowed := [][2]string{{"Quarantined", "Tested"}, {"Tested", "Available"}, {"Available", "Reserved"}, {"Reserved", "Partially Used"}, {"Partially Used", "Used"}}
+    for _, transition := range allowed {
+        if !canTransition(transition[0], transition[1]) {
+            t.Fatalf("%s -> %s should be allowed", transition[0], transition[1])
+        }
+    }
+    for _, terminal := range []string{"Used", "Disposed"} {
+        for _, status := range bloodUnitStatuses {
+            if canTransition(terminal, status) {
+                t.Fatalf("%s is terminal but may move to %s", terminal, status)
+            }
+        }
+    }
+}
+
+func TestLegacyUnitTimestamps(t *testing.T) {
+    s, ctx := newTestContract()
+    // OLD predates the timestamp fields, BLANK was rewritten before writes filled them in
+    ctx.stub().state["OLD"] = []byte(`{"docType":"bloodUnit","unitID":"OLD","donorID":"D1","bloodType":"O-","quantity":450,"status":"Tested","testResult":"Safe","componentType":"Whole Blood","date":"2024-02-28 08:00:00","expiryDate":"2024-04-10 08:00:00"}`)
+    ctx.stub().state["BLANK"] = []byte(`{"docType":"bloodUnit","unitID":"BLANK","donorID":"D1","bloodType":"O-","quantity":450,"status":"Available","testResult":"Safe","componentType":"Whole Blood","date":"2024-02-28 09:00:00","expiryDate":"2024-04-10 09:00:00","collectedAt":"","expiresAt":""}`)
+
+    if err := s.MakeAvailable(ctx, "OLD"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    unit, err := s.QueryBloodUnit(ctx, "OLD")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if unit.CollectedAt != "2024-02-28T08:00:00Z" || unit.ExpiresAt != "2024-04-10T08:00:00Z" {
+        t.Fatalf("Timestamps not filled on write: %q %q", unit.CollectedAt, unit.ExpiresAt)
+    }
+
+    expired, err := s.ExpireStaleUnits(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(expired) != 0 {
+        t.Fatalf("Fresh units expired: %v", expired)
+    }
+
+    updated, err := s.BackfillTimestamps(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if updated != 1 {
+        t.Fatalf("Expected the blank unit to be backfilled, updated %d", updated)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    units, err := s.QueryUnitsCollectedOnDate(ctx, "2024-02-28")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(units) != 2 {
+        t.Fatalf("Expected both units collected on 2024-02-28, got %d", len(units))
+    }
+}
+
+// registerPrivateDonor registers a consenting donor whose personal details go to the private collection
+func registerPrivateDonor(t *testing.T, s *BloodDonationChaincode, ctx *fakeContext, donorID string, bloodType string) {
+    t.Helper()
+    ctx.stub().transient = map[string][]byte{donorDetailsTransientKey: []byte(`{"name":"Hidden","dateOfBirth":"1990-01-01","gender":"Male","salt":"5f0c1e9a7b3d2468ace1"}`)}
+    if err := s.RegisterDonorPrivate(ctx, donorID, bloodType, "none"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().transient = nil
+    ctx.stub().nextTx(t, time.Minute)
+    if err := s.RecordConsent(ctx, donorID, true, "2024-01-01"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+}
+
+func TestHashedUnitsStillFoundByDonor(t *testing.T) {
+    s, ctx := newTestContract()
+    registerPrivateDonor(t, s, ctx, "P1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "P1", "O-", "A1")
+
+    retest, err := s.GetUnitsNeedingRetest(ctx, "P1", 30)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(retest) != 1 || retest[0].UnitID != "U1" {
+        t.Fatalf("Hashed unit missing from retest list: %+v", retest)
+    }
+    expectError(t, s.DeleteDonor(ctx, "P1"), "U1")
+
+    rankings, err := s.GetTopDonors(ctx, 5)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(rankings) != 0 {
+        t.Fatalf("Hashed units ranked under an empty donor: %+v", rankings)
+    }
+
+    recall, err := s.RecallDonorUnits(ctx, "P1", "Positive follow-up screen")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(recall.RecalledUnitIDs) != 1 || recall.RecalledUnitIDs[0] != "U1" {
+        t.Fatalf("Hashed unit not recalled: %+v", recall)
+    }
+}
+
+func TestDonorTimelineUsesEligibilityRecords(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+    if err := s.SetDonorEligibility(ctx, "D1", false, "Low hemoglobin"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Hour)
+    if err := s.SetDonorEligibility(ctx, "D1", true, ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Hour)
+
+    timeline, err := s.QueryDonorTimeline(ctx, "D1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := []string{"Donation", "Deferred", "Reinstated"}
+    if len(timeline) != len(expected) {
+        t.Fatalf("Timeline has %d events, expected %d: %+v", len(timeline), len(expected), timeline)
+    }
+    for i, eventType := range expected {
+        if timeline[i].EventType != eventType {
+            t.Fatalf("Event %d is %s, expected %s", i, timeline[i].EventType, eventType)
+        }
+    }
+    if timeline[1].Reason != "Low hemoglobin" {
+        t.Fatalf("Deferral reason is %q", timeline[1].Reason)
+    }
+}
+
+func TestBloodUnitHistoryOldestFirst(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+
+    history, err := s.QueryBloodUnitHistory(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(history) < 2 {
+        t.Fatalf("Expected several versions, got %d", len(history))
+    }
+    for i := 1; i < len(history); i++ {
+        if history[i].BloodUnit.Version <= history[i-1].BloodUnit.Version {
+            t.Fatalf("History not oldest first: version %d follows %d", history[i].BloodUnit.Version, history[i-1].BloodUnit.Version)
+        }
+    }
+}
+
+func TestAcceptBloodFIFOEmitsSingleEvent(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    if err := s.SetLowStockThreshold(ctx, "O-", 400); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    ctx.stub().events, ctx.stub().payloads = nil, nil
+    if _, err := s.AcceptBloodFIFO(ctx, "A1", "P1", "O-", 100, false); err != nil {
+        t.Fatal(err)
+    }
+    if len(ctx.stub().events) != 1 || ctx.stub().events[0] != "LowStock" {
+        t.Fatalf("Expected a single LowStock event, got %v", ctx.stub().events)
+    }
+    var event LowStockEvent
+    if err := json.Unmarshal(ctx.stub().payloads[0], &event); err != nil {
+        t.Fatal(err)
+    }
+    if event.CurrentLevel != 350 || len(event.Accepted) != 1 || event.Accepted[0].UnitID != "U1" {
+        t.Fatalf("LowStock event does not carry the acceptance: %+v", event)
+    }
+}
+
+func TestUpdatePrivateDonorKeepsDetailsOffLedger(t *testing.T) {
+    s, ctx := newTestContract()
+    registerPrivateDonor(t, s, ctx, "P1", "O-")
+
+    _, err := s.UpdateDonor(ctx, "P1", "Public Name", "O-", "p1@example.com", "", "1990-01-01", "Male", "none", false)
+    expectError(t, err, "UpdateDonorPrivate")
+
+    ctx.stub().transient = map[string][]byte{donorDetailsTransientKey: []byte(`{"name":"Renamed","email":"p1@example.com","dateOfBirth":"1990-01-01","gender":"Male","salt":"0000000000000000"}`)}
+    if err := s.UpdateDonorPrivate(ctx, "P1", "none"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().transient = nil
+    ctx.stub().nextTx(t, time.Minute)
+
+    donor, err := s.QueryDonor(ctx, "P1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if donor.Name != "" || donor.Email != "" {
+        t.Fatalf("Personal details written to the public record: %+v", donor)
+    }
+    details, err := s.QueryDonorPrivate(ctx, "P1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if details.Name != "Renamed" || details.Salt != "5f0c1e9a7b3d2468ace1" {
+        t.Fatalf("Private details not updated or salt replaced: %+v", details)
+    }
+}
+
+func TestMakeAvailableIgnoresCacheCountingTestedUnits(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+    if err := s.TestBlood(ctx, "U1", "Safe"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    // A cache written before Tested units stopped counting as stock already includes U1
+    cacheKey, _ := ctx.stub().CreateCompositeKey("inventoryCache", []string{"O-"})
+    ctx.stub().state[cacheKey] = []byte(`{"docType":"inventoryCache","version":1,"summary":{"bloodType":"O-","totalQuantity":450,"unitCount":1}}`)
+
+    if err := s.MakeAvailable(ctx, "U1"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    inventory, err := s.GetInventorySummary(ctx, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(inventory) != 1 || inventory[0].TotalQuantity != 450 || inventory[0].UnitCount != 1 {
+        t.Fatalf("Unit counted twice in the inventory: %+v", inventory[0])
+    }
+}
+
+func TestPartialTransferStartsFresh(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    registerAcceptor(t, s, ctx, "A2", "General Hospital")
+    if _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 100, false, ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    if err := s.TransferBlood(ctx, "U1", "A1", "A2", 150); err != nil {
+        t.Fatal(err)
+    }
+    transferID := "U1-" + ctx.stub().GetTxID()
+    ctx.stub().nextTx(t, time.Minute)
+
+    parent, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if parent.Quantity != 200 || parent.DispensedQuantity != 100 {
+        t.Fatalf("Parent is %d mL with %d mL dispensed", parent.Quantity, parent.DispensedQuantity)
+    }
+    transferred, err := s.QueryBloodUnit(ctx, transferID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if transferred.Quantity != 150 || transferred.DispensedQuantity != 0 || transferred.Status != "Available" {
+        t.Fatalf("Transferred unit is %d mL with %d mL dispensed in status %s", transferred.Quantity, transferred.DispensedQuantity, transferred.Status)
+    }
+}
+
+func TestDisposeRecalledUnit(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    expectError(t, s.DisposeUnit(ctx, "U1", "Damaged bag"), "cannot be disposed of")
+
+    if _, err := s.RecallDonorUnits(ctx, "D1", "Positive follow-up screen"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    if err := s.DisposeUnit(ctx, "U1", "Recalled after follow-up screen"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    bloodUnit, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bloodUnit.Status != "Disposed" {
+        t.Fatalf("Recalled unit is %s, expected Disposed", bloodUnit.Status)
+    }
+}
+
+func TestInitLedgerRefusesExistingRecords(t *testing.T) {
+    s, ctx := newTestContract()
+    registerAcceptor(t, s, ctx, "ACCEPTOR1", "Existing Hospital")
+    expectError(t, s.InitLedger(ctx), "ACCEPTOR1")
+
+    s, ctx = newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    expectError(t, s.InitLedger(ctx), "cannot be seeded")
+
+    s, ctx = newTestContract()
+    if err := s.InitLedger(ctx); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    expectError(t, s.InitLedger(ctx), "already been initialized")
+}
+
+func TestInventoryCacheKeyedByBloodType(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    registerDonor(t, s, ctx, "D2", "A+")
+    donate(t, s, ctx, "U2", "D2", "A+", "A1")
+    makeAvailable(t, s, ctx, "U2", "P2")
+    if _, err := s.GetInventorySummary(ctx, true); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    // Dispensing different blood types at the same time must not conflict on the cache
+    if _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 100, false, ""); err != nil {
+        t.Fatal(err)
+    }
+    first := ctx.stub().endorse()
+    if _, err := s.AcceptBlood(ctx, "U2", "A1", "P2", 200, false, ""); err != nil {
+        t.Fatal(err)
+    }
+    second := ctx.stub().endorse()
+    if err := ctx.stub().commit(first); err != nil {
+        t.Fatal(err)
+    }
+    if err := ctx.stub().commit(second); err != nil {
+        t.Fatal(err)
+    }
+
+    inventory, err := s.GetInventorySummary(ctx, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(inventory) != 2 {
+        t.Fatalf("Cached inventory has %d blood types, expected 2", len(inventory))
+    }
+    if inventory[0].BloodType != "A+" || inventory[0].TotalQuantity != 250 || inventory[1].TotalQuantity != 350 {
+        t.Fatalf("Unexpected cached inventory: %+v %+v", inventory[0], inventory[1])
+    }
+}
+
+func TestDonationForLegacyIDs(t *testing.T) {
+    s, ctx := newTestContract()
+
+    // Records registered before IDs were validated may use characters that are no longer accepted
+    donorBytes, _ := json.Marshal(Donor{DocType: "donor", DonorID: "Donor #1", BloodType: "O-", DateOfBirth: "1990-01-01", Gender: "Male", NotificationPreference: "none", Eligible: true, ConsentStatus: true})
+    acceptorBytes, _ := json.Marshal(Acceptor{DocType: "acceptor", AcceptorID: "City Hospital #1", Name: "City Hospital", Location: "Chennai"})
+    ctx.stub().state["Donor #1"] = donorBytes
+    ctx.stub().state["City Hospital #1"] = acceptorBytes
+
+    if err := s.RecordDonation(ctx, "U1", "Donor #1", "O-", 450, "City Hospital", "City Hospital #1", ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    err := s.RecordDonation(ctx, "Unit #2", "Donor #1", "O-", 450, "City Hospital", "City Hospital #1", "")
+    expectError(t, err, "Invalid unit ID")
+}
+
+func TestLegacyDonorDateOfBirth(t *testing.T) {
+    s, ctx := newTestContract()
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    registerDonor(t, s, ctx, "D1", "O-")
+
+    // A donor registered before the date of birth was required
+    donorBytes, _ := json.Marshal(Donor{DocType: "donor", DonorID: "LEGACY", BloodType: "O-", NotificationPreference: "none", Eligible: true, ConsentStatus: true})
+    ctx.stub().state["LEGACY"] = donorBytes
+    youngBytes, _ := json.Marshal(Donor{DocType: "donor", DonorID: "YOUNG", BloodType: "O-", DateOfBirth: "2010-01-01", Gender: "Male", NotificationPreference: "none", Eligible: true, ConsentStatus: true})
+    ctx.stub().state["YOUNG"] = youngBytes
+
+    donors, err := s.QueryDonorsByBloodType(ctx, "O-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(donors) != 1 || donors[0].DonorID != "D1" {
+        t.Fatalf("Expected only D1 for outreach, got %d donors", len(donors))
+    }
+
+    err = s.RecordDonation(ctx, "U1", "LEGACY", "O-", 450, "City Hospital", "A1", "")
+    expectError(t, err, "SetDonorDateOfBirth")
+
+    if err := s.SetDonorDateOfBirth(ctx, "LEGACY", "1985-06-30", "Female"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    expectError(t, s.SetDonorDateOfBirth(ctx, "LEGACY", "1985-06-30", "Female"), "already has a date of birth")
+    if err := s.RecordDonation(ctx, "U1", "LEGACY", "O-", 450, "City Hospital", "A1", ""); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestReservedQuantityEnforced(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    registerAcceptor(t, s, ctx, "A2", "Lake Clinic")
+    if err := s.ReserveBlood(ctx, "U1", "A1", 200); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    _, err := s.AcceptBlood(ctx, "U1", "A2", "P1", 300, false, "")
+    expectError(t, err, "only 250 mL is unreserved")
+    result, err := s.AcceptBlood(ctx, "U1", "A2", "P1", 250, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    if result.NewStatus != "Reserved" {
+        t.Fatalf("Unit is %s after an unreserved draw, expected Reserved", result.NewStatus)
+    }
+    _, err = s.AcceptBlood(ctx, "U1", "A2", "P1", 10, false, "")
+    expectError(t, err, "only 0 mL is unreserved")
+
+    if _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 100, false, ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    unit, err := s.QueryBloodUnit(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if unit.Status != "Reserved" || unit.ReservedQuantity != 100 || unit.Quantity != 100 {
+        t.Fatalf("Unexpected unit after a reserved draw: status %s, reserved %d, quantity %d", unit.Status, unit.ReservedQuantity, unit.Quantity)
+    }
+
+    result, err = s.AcceptBlood(ctx, "U1", "A1", "P1", 100, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.NewStatus != "Used" {
+        t.Fatalf("Unit is %s once drawn in full, expected Used", result.NewStatus)
+    }
+}
+
+func TestPrivateDonorUnitsHashedAtCreation(t *testing.T) {
+    s, ctx := newTestContract()
+    registerPrivateDonor(t, s, ctx, "P1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "P1", "O-", "A1")
+    if err := s.TestBlood(ctx, "U1", "Safe"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    history, err := s.QueryBloodUnitHistory(ctx, "U1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, entry := range history {
+        if entry.BloodUnit.DonorID != "" || entry.BloodUnit.DonorHash == "" {
+            t.Fatalf("Version %d of the unit has donor ID %q and hash %q", entry.BloodUnit.Version, entry.BloodUnit.DonorID, entry.BloodUnit.DonorHash)
+        }
+    }
+    expectError(t, s.SetDonorHash(ctx, "U1"), "already references its donor by hash")
+
+    // Units recorded before donations were hashed at creation are backfilled with SetDonorHash
+    legacyBytes, _ := json.Marshal(BloodUnit{DocType: "bloodUnit", UnitID: "U0", DonorID: "P1", BloodType: "O-", Quantity: 450, Status: "Quarantined"})
+    ctx.stub().state["U0"] = legacyBytes
+    if err := s.SetDonorHash(ctx, "U0"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    matches, err := s.VerifyDonorHash(ctx, "U0", "P1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !matches {
+        t.Fatal("Backfilled hash does not match the donor")
+    }
+}
+
+func TestLegacyDonorWithoutEligibleField(t *testing.T) {
+    s, ctx := newTestContract()
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+
+    // A donor stored before the eligible field existed
+    ctx.stub().state["LEGACY"] = []byte(`{"docType":"donor","donorID":"LEGACY","bloodType":"O-","dateOfBirth":"1985-06-30","gender":"Female","notificationPreference":"none","consentStatus":true}`)
+
+    donors, err := s.QueryDonorsByBloodType(ctx, "O-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(donors) != 1 || donors[0].DonorID != "LEGACY" {
+        t.Fatalf("Legacy donor left out of outreach, got %d donors", len(donors))
+    }
+    nextEligibility, err := s.ComputeNextEligibleDate(ctx, "LEGACY")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if nextEligibility.Deferred || !nextEligibility.EligibleNow {
+        t.Fatalf("Legacy donor reported as %+v", nextEligibility)
+    }
+    if err := s.RecordDonation(ctx, "U1", "LEGACY", "O-", 450, "City Hospital", "A1", ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    // An explicit deferral is still honoured
+    if err := s.SetDonorEligibility(ctx, "LEGACY", false, "Low hemoglobin"); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+    donor, err := s.QueryDonor(ctx, "LEGACY")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if donor.Eligible {
+        t.Fatal("Deferred donor read back as eligible")
+    }
+}
+
+func TestRecordsOfOtherTypesNotFound(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+    donate(t, s, ctx, "U1", "D1", "O-", "A1")
+
+    err := s.RecordDonation(ctx, "U2", "D1", "O-", 450, "City Hospital", "D1", "")
+    if !errors.Is(err, ErrAcceptorNotFound) {
+        t.Fatalf("Donor ID accepted as the acceptor: %v", err)
+    }
+    _, err = s.AcceptBlood(ctx, "U1", "D1", "P1", 100, false, "")
+    if !errors.Is(err, ErrAcceptorNotFound) {
+        t.Fatalf("Donor ID accepted as the acceptor: %v", err)
+    }
+    _, err = s.QueryBloodUnit(ctx, "D1")
+    if !errors.Is(err, ErrUnitNotFound) {
+        t.Fatalf("Donor read as a blood unit: %v", err)
+    }
+    _, err = s.QueryDonor(ctx, "A1")
+    if !errors.Is(err, ErrDonorNotFound) {
+        t.Fatalf("Acceptor read as a donor: %v", err)
+    }
+}
+
+func TestStateCacheWithinTransaction(t *testing.T) {
+    _, ctx := newTestContract()
+    ctx.stub().state["D1"] = []byte(`{"docType":"donor","donorID":"D1"}`)
+
+    for i := 0; i < 2; i++ {
+        if _, err := getState(ctx, "D1"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if ctx.stub().reads["D1"] != 1 {
+        t.Fatalf("Repeated read hit the stub %d times, expected once", ctx.stub().reads["D1"])
+    }
+
+    // A write drops the cached value, and the next read goes back to the stub, which like a peer
+    // still returns the committed value
+    if err := putState(ctx, "D1", []byte(`{"docType":"donor","donorID":"D1","name":"Changed"}`)); err != nil {
+        t.Fatal(err)
+    }
+    value, err := getState(ctx, "D1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ctx.stub().reads["D1"] != 2 {
+        t.Fatalf("Read after a write was served from the cache")
+    }
+    if strings.Contains(string(value), "Changed") {
+        t.Fatalf("Read saw a write of the same transaction: %s", value)
+    }
+
+    // The next transaction starts with an empty cache and sees the committed write
+    ctx.stub().nextTx(t, time.Minute)
+    value, err = getState(ctx, "D1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(string(value), "Changed") {
+        t.Fatalf("Next transaction read a stale value: %s", value)
+    }
+}
+
+func TestEmergencyOverrideRecordedInEventLog(t *testing.T) {
+    s, ctx := setupAvailableUnit(t)
+    if err := s.SetReserveFloor(ctx, "O-", 400); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 100, false, "")
+    expectError(t, err, "below its reserve floor")
+    if _, err := s.AcceptBlood(ctx, "U1", "A1", "P1", 100, true, ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx.stub().nextTx(t, time.Minute)
+
+    entries, err := s.QueryEventLog(ctx, "2024-01-01", "2025-01-01", "EmergencyOverride")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 1 {
+        t.Fatalf("Expected one emergency override in the event log, got %d", len(entries))
+    }
+    var event EmergencyOverrideEvent
+    if err := json.Unmarshal(entries[0].Payload, &event); err != nil {
+        t.Fatal(err)
+    }
+    if event.Floor != 400 || event.CurrentLevel != 350 || len(event.UnitIDs) != 1 || event.UnitIDs[0] != "U1" || event.PatientID != "P1" {
+        t.Fatalf("Unexpected emergency override entry: %+v", event)
+    }
+}
+
+func TestDonationBatchRetriesFailedEntry(t *testing.T) {
+    s, ctx := newTestContract()
+    registerDonor(t, s, ctx, "D1", "O-")
+    registerDonor(t, s, ctx, "D2", "A+")
+    registerAcceptor(t, s, ctx, "A1", "City Hospital")
+
+    results, err := s.RecordDonationBatch(ctx, `[
+        {"unitID":"U1","donorID":"D1","bloodType":"O-","quantity":45,"hospitalName":"City Hospital","acceptorID":"A1"},
+        {"unitID":"U1","donorID":"D1","bloodType":"O-","quantity":450,"hospitalName":"City Hospital","acceptorID":"A1"},
+        {"unitID":"U2","donorID":"D1","bloodType":"O-","quantity":450,"hospitalName":"City Hospital","acceptorID":"A1"},
+        {"unitID":"U1","donorID":"D2","bloodType":"A+","quantity":450,"hospitalName":"City Hospital","acceptorID":"A1"}
+    ]`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := []string{"Donation volume must be between", "", "Donor D1 appears more than once", "Blood unit with ID U1 appears more than once"}
+    for i, want := range expected {
+        if want == "" {
+            if !results[i].Success {
+                t.Fatalf("Corrected entry %d failed: %s", i, results[i].Error)
+            }
+            continue
+        }
+        if results[i].Success || !strings.Contains(results[i].Error, want) {
+            t.Fatalf("Entry %d: expected an error mentioning %q, got %+v", i, want, results[i])
+        }
+    }
+}
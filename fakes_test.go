@@ -0,0 +1,399 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+    "github.com/hyperledger/fabric-chaincode-go/shim"
+    "github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+    pb "github.com/hyperledger/fabric-protos-go/peer"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeIdentity is a client identity with a fixed ID, MSP and attributes
+type fakeIdentity struct {
+    cid.ClientIdentity
+    id    string
+    mspID string
+    attrs map[string]string
+}
+
+func (i *fakeIdentity) GetID() (string, error)    { return i.id, nil }
+func (i *fakeIdentity) GetMSPID() (string, error) { return i.mspID, nil }
+func (i *fakeIdentity) GetAttributeValue(name string) (string, bool, error) {
+    value, ok := i.attrs[name]
+    return value, ok, nil
+}
+func (i *fakeIdentity) AssertAttributeValue(name string, value string) error {
+    if i.attrs[name] != value {
+        return fmt.Errorf("Attribute %s does not have value %s", name, value)
+    }
+    return nil
+}
+
+// fakeContext is the transaction context handed to the contract in tests. It is the real
+// stateCachingContext, set up with the fake stub and identity, so reads go through its cache.
+type fakeContext = stateCachingContext
+
+func (c *fakeContext) stub() *fakeStub         { return c.GetStub().(*fakeStub) }
+func (c *fakeContext) identity() *fakeIdentity { return c.GetClientIdentity().(*fakeIdentity) }
+
+// historyEntry is one write to a key, as returned by GetHistoryForKey
+type historyEntry struct {
+    txID     string
+    value    []byte
+    isDelete bool
+    at       time.Time
+}
+
+// fakeStub is an in-memory world state behaving like a peer: writes are buffered until the transaction
+// commits, so a transaction never reads its own writes, and commit fails on an MVCC read conflict.
+// Methods the contract does not use are left to the embedded interface and panic if called.
+type fakeStub struct {
+    shim.ChaincodeStubInterface
+    state     map[string][]byte
+    private   map[string]map[string][]byte
+    history   map[string][]historyEntry
+    transient map[string][]byte
+    events    []string
+    payloads  [][]byte
+    now       time.Time
+    txNumber  int
+    reads     map[string]int // Number of GetState calls per key
+    onNewTx   func()         // Called when a transaction ends, contractapi hands each one a new context
+
+    writes  map[string][]byte // Pending writes of the current transaction, nil value for a delete
+    readSet map[string][]byte // Value of every key the current transaction read
+}
+
+// pendingTx is an endorsed but uncommitted transaction
+type pendingTx struct {
+    txID    string
+    at      time.Time
+    writes  map[string][]byte
+    readSet map[string][]byte
+}
+
+func newFakeContext() *fakeContext {
+    ctx := new(fakeContext)
+    stub := &fakeStub{
+        state:   map[string][]byte{},
+        private: map[string]map[string][]byte{},
+        history: map[string][]historyEntry{},
+        now:     time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+        reads:   map[string]int{},
+        onNewTx: func() { ctx.stateCache = nil },
+        writes:  map[string][]byte{},
+        readSet: map[string][]byte{},
+    }
+    ctx.SetStub(stub)
+    ctx.SetClientIdentity(&fakeIdentity{id: "user1", mspID: authorizedLabMSPID})
+    return ctx
+}
+
+// endorse ends the current transaction without committing it, as a peer does when simulating
+func (s *fakeStub) endorse() *pendingTx {
+    tx := &pendingTx{txID: s.GetTxID(), at: s.now, writes: s.writes, readSet: s.readSet}
+    s.writes = map[string][]byte{}
+    s.readSet = map[string][]byte{}
+    s.txNumber++
+    s.onNewTx()
+    return tx
+}
+
+// commit validates and applies an endorsed transaction, failing if any key it read has changed since
+func (s *fakeStub) commit(tx *pendingTx) error {
+    for key, value := range tx.readSet {
+        if string(s.state[key]) != string(value) {
+            return fmt.Errorf("MVCC_READ_CONFLICT on key %q", key)
+        }
+    }
+    for key, value := range tx.writes {
+        if value == nil {
+            delete(s.state, key)
+        } else {
+            s.state[key] = value
+        }
+        s.history[key] = append(s.history[key], historyEntry{txID: tx.txID, value: value, isDelete: value == nil, at: tx.at})
+    }
+    return nil
+}
+
+// nextTx commits the current transaction and starts the next one after the given time has passed
+func (s *fakeStub) nextTx(t *testing.T, elapsed time.Duration) {
+    t.Helper()
+    if err := s.commit(s.endorse()); err != nil {
+        t.Fatal(err)
+    }
+    s.now = s.now.Add(elapsed)
+}
+
+func (s *fakeStub) GetTxID() string      { return fmt.Sprintf("tx%d", s.txNumber) }
+func (s *fakeStub) GetChannelID() string { return "channel" }
+
+func (s *fakeStub) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+    return timestamppb.New(s.now), nil
+}
+
+func (s *fakeStub) GetState(key string) ([]byte, error) {
+    value := s.state[key]
+    s.readSet[key] = value
+    s.reads[key]++
+    return value, nil
+}
+
+func (s *fakeStub) PutState(key string, value []byte) error {
+    if key == "" {
+        return fmt.Errorf("Empty key")
+    }
+    s.writes[key] = value
+    return nil
+}
+
+func (s *fakeStub) DelState(key string) error {
+    s.writes[key] = nil
+    return nil
+}
+
+func (s *fakeStub) SetEvent(name string, payload []byte) error {
+    s.events = append(s.events, name)
+    s.payloads = append(s.payloads, payload)
+    return nil
+}
+
+func (s *fakeStub) GetTransient() (map[string][]byte, error) {
+    if s.transient == nil {
+        return map[string][]byte{}, nil
+    }
+    return s.transient, nil
+}
+
+func (s *fakeStub) GetPrivateData(collection string, key string) ([]byte, error) {
+    return s.private[collection][key], nil
+}
+
+func (s *fakeStub) PutPrivateData(collection string, key string, value []byte) error {
+    if s.private[collection] == nil {
+        s.private[collection] = map[string][]byte{}
+    }
+    s.private[collection][key] = value
+    return nil
+}
+
+func (s *fakeStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+    key := "\x00" + objectType + "\x00"
+    for _, attribute := range attributes {
+        key += attribute + "\x00"
+    }
+    return key, nil
+}
+
+func (s *fakeStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+    parts := strings.Split(strings.Trim(compositeKey, "\x00"), "\x00")
+    return parts[0], parts[1:], nil
+}
+
+func (s *fakeStub) sortedKeys() []string {
+    var keys []string
+    for key := range s.state {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func (s *fakeStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+    iterator, _, err := s.GetStateByRangeWithPagination(startKey, endKey, 0, "")
+    return iterator, err
+}
+
+func (s *fakeStub) GetStateByRangeWithPagination(startKey string, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+    var results []*queryresult.KV
+    for _, key := range s.sortedKeys() {
+        // Composite keys live in their own namespace and are never returned by range queries
+        if strings.HasPrefix(key, "\x00") {
+            continue
+        }
+        if key >= startKey && (endKey == "" || key < endKey) && key >= bookmark {
+            results = append(results, &queryresult.KV{Key: key, Value: s.state[key]})
+        }
+    }
+    return paginate(results, pageSize)
+}
+
+func (s *fakeStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+    prefix, _ := s.CreateCompositeKey(objectType, attributes)
+    var results []*queryresult.KV
+    for _, key := range s.sortedKeys() {
+        if strings.HasPrefix(key, prefix) {
+            results = append(results, &queryresult.KV{Key: key, Value: s.state[key]})
+        }
+    }
+    return &fakeIterator{results: results}, nil
+}
+
+func (s *fakeStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+    iterator, _, err := s.GetQueryResultWithPagination(query, 0, "")
+    return iterator, err
+}
+
+func (s *fakeStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+    var parsed struct {
+        Selector map[string]interface{} `json:"selector"`
+    }
+    if err := json.Unmarshal([]byte(query), &parsed); err != nil {
+        return nil, nil, fmt.Errorf("Invalid query %q: %v", query, err)
+    }
+    var results []*queryresult.KV
+    for _, key := range s.sortedKeys() {
+        var doc map[string]interface{}
+        if json.Unmarshal(s.state[key], &doc) != nil || key < bookmark {
+            continue
+        }
+        if matchesSelector(doc, parsed.Selector) {
+            results = append(results, &queryresult.KV{Key: key, Value: s.state[key]})
+        }
+    }
+    return paginate(results, pageSize)
+}
+
+// GetHistoryForKey returns the committed writes to a key newest first, as Fabric 2.x does
+func (s *fakeStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+    var modifications []*queryresult.KeyModification
+    for i := len(s.history[key]) - 1; i >= 0; i-- {
+        entry := s.history[key][i]
+        modifications = append(modifications, &queryresult.KeyModification{TxId: entry.txID, Value: entry.value, IsDelete: entry.isDelete, Timestamp: timestamppb.New(entry.at)})
+    }
+    return &fakeHistoryIterator{modifications: modifications}, nil
+}
+
+// paginate cuts a page of pageSize results, zero meaning all of them, with the next key as bookmark
+func paginate(results []*queryresult.KV, pageSize int32) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+    bookmark := ""
+    if pageSize > 0 && int(pageSize) < len(results) {
+        bookmark = results[pageSize].Key
+        results = results[:pageSize]
+    }
+    return &fakeIterator{results: results}, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(results)), Bookmark: bookmark}, nil
+}
+
+// matchesSelector evaluates the subset of CouchDB selector syntax the contract uses
+func matchesSelector(doc map[string]interface{}, selector map[string]interface{}) bool {
+    for field, condition := range selector {
+        switch field {
+        case "$or":
+            matched := false
+            for _, sub := range condition.([]interface{}) {
+                matched = matched || matchesSelector(doc, sub.(map[string]interface{}))
+            }
+            if !matched {
+                return false
+            }
+            continue
+        case "$and":
+            for _, sub := range condition.([]interface{}) {
+                if !matchesSelector(doc, sub.(map[string]interface{})) {
+                    return false
+                }
+            }
+            continue
+        }
+
+        value, present := doc[field]
+        operators, isOperators := condition.(map[string]interface{})
+        if !isOperators {
+            operators = map[string]interface{}{"$eq": condition}
+        }
+        for operator, argument := range operators {
+            if !matchesOperator(value, present, operator, argument) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func matchesOperator(value interface{}, present bool, operator string, argument interface{}) bool {
+    switch operator {
+    case "$exists":
+        return present == argument.(bool)
+    case "$ne":
+        return !present || fmt.Sprint(value) != fmt.Sprint(argument)
+    case "$nin":
+        for _, candidate := range argument.([]interface{}) {
+            if present && fmt.Sprint(value) == fmt.Sprint(candidate) {
+                return false
+            }
+        }
+        return true
+    }
+    if !present {
+        return false
+    }
+    switch operator {
+    case "$eq":
+        return fmt.Sprint(value) == fmt.Sprint(argument)
+    case "$in":
+        for _, candidate := range argument.([]interface{}) {
+            if fmt.Sprint(value) == fmt.Sprint(candidate) {
+                return true
+            }
+        }
+        return false
+    case "$regex":
+        matched, err := regexp.MatchString(argument.(string), fmt.Sprint(value))
+        return err == nil && matched
+    case "$gt", "$gte", "$lt", "$lte":
+        var comparison int
+        if number, ok := value.(float64); ok {
+            switch bound := argument.(float64); {
+            case number < bound:
+                comparison = -1
+            case number > bound:
+                comparison = 1
+            }
+        } else {
+            comparison = strings.Compare(fmt.Sprint(value), fmt.Sprint(argument))
+        }
+        switch operator {
+        case "$gt":
+            return comparison > 0
+        case "$gte":
+            return comparison >= 0
+        case "$lt":
+            return comparison < 0
+        }
+        return comparison <= 0
+    }
+    panic("unsupported selector operator " + operator)
+}
+
+type fakeIterator struct {
+    results []*queryresult.KV
+    next    int
+}
+
+func (i *fakeIterator) HasNext() bool { return i.next < len(i.results) }
+func (i *fakeIterator) Close() error  { return nil }
+func (i *fakeIterator) Next() (*queryresult.KV, error) {
+    i.next++
+    return i.results[i.next-1], nil
+}
+
+type fakeHistoryIterator struct {
+    modifications []*queryresult.KeyModification
+    next          int
+}
+
+func (i *fakeHistoryIterator) HasNext() bool { return i.next < len(i.modifications) }
+func (i *fakeHistoryIterator) Close() error  { return nil }
+func (i *fakeHistoryIterator) Next() (*queryresult.KeyModification, error) {
+    i.next++
+    return i.modifications[i.next-1], nil
+}